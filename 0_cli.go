@@ -1,17 +1,20 @@
 package moontpl
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
-	"log"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/alexflint/go-arg"
 	"github.com/samber/lo"
 )
@@ -20,12 +23,27 @@ import (
 var embedded embed.FS
 
 type buildCmd struct {
-	SiteDir    string `arg:"required,positional" help:"directory that contains the source lua files"`
-	OutputDir  string `arg:"positional" help:"directory where the rendered html files will be placed" default:"output"`
-	CopyFiles  bool   `help:"copy and include static files (such as images) in the output" default:"true"`
-	CopySource bool   `help:"copy and include source lua files in the output" default:"false"`
-	Test       bool   `help:"runs only the lua files, but do not write or copy files" default:"false"`
-	Print      bool   `help:"prints the output of each file to STDOUT" default:"false"`
+	SiteDir     string `arg:"required,positional" help:"directory that contains the source lua files"`
+	OutputDir   string `arg:"positional" help:"directory where the rendered html files will be placed [default: output]"`
+	CopyFiles   *bool  `help:"copy and include static files (such as images) in the output [default: true]"`
+	CopySource  *bool  `help:"copy and include source lua files in the output [default: false]"`
+	Test        bool   `help:"runs only the lua files, but do not write or copy files" default:"false"`
+	Print       bool   `help:"prints the output of each file to STDOUT" default:"false"`
+	Jobs        int    `arg:"-j" help:"number of pages to render in parallel, 0 uses the number of CPUs" default:"1"`
+	Force       bool   `arg:"-f" help:"rebuild all files, ignoring the build manifest of the previous build in .moontpl-cache next to OUTPUTDIR" default:"false"`
+	FailFast    bool   `help:"stop the build on the first error" default:"false"`
+	Clean       bool   `help:"remove files in OUTPUTDIR that were not produced by the build" default:"false"`
+	DryRun      bool   `help:"with --clean, only list the files that would be removed" default:"false"`
+	CheckLinks  bool   `help:"check that the local links and fragments in the built pages are not broken" default:"false"`
+	SiteURL     string `help:"URL where the site will be deployed, such as https://example.org"`
+	Sitemap     bool   `help:"generate a sitemap.xml, requires --siteurl" default:"false"`
+	Robots      bool   `help:"generate a robots.txt that points to the sitemap, requires --sitemap" default:"false"`
+	Minify      *bool  `help:"minify the html, css and js output, same as -t minify [default: false]"`
+	Fingerprint bool   `help:"also write static files and non-HTML outputs with a content hash in the file name, see path.asset" default:"false"`
+}
+
+type checkCmd struct {
+	SiteDir string `arg:"required,positional" help:"directory that contains the source lua files"`
 }
 
 type runCmd struct {
@@ -46,7 +64,18 @@ The alternative is to set the LUADIR.
 
 type serveCmd struct {
 	SiteDir string `arg:"required,positional" help:"directory that contains the source lua files to serve in a web server"`
-	Port    int    `help:"HTTP port to use" default:"9876"`
+	Port    *int   `help:"HTTP port to use [default: 9876]"`
+}
+
+type configCmd struct {
+	SiteDir string `arg:"positional" help:"directory that contains the source lua files" default:"."`
+}
+
+func (*configCmd) Epilogue() string {
+	return `The config file is moontpl.toml or moontpl.lua, found in SITEDIR or in the CWD.
+The flags override the options in the file, and the list flags
+such as --luadir are added to the lists in the file.
+`
 }
 
 type luaDocCmd struct {
@@ -57,10 +86,19 @@ type cliArgs struct {
 	Build  *buildCmd  `arg:"subcommand:build"`
 	Run    *runCmd    `arg:"subcommand:run"`
 	Serve  *serveCmd  `arg:"subcommand:serve"`
+	Check  *checkCmd  `arg:"subcommand:check"`
 	LuaDoc *luaDocCmd `arg:"subcommand:luadoc"`
+	Config *configCmd `arg:"subcommand:config"`
+	Init   *initCmd   `arg:"subcommand:init"`
 
 	LuaDir []string `arg:"-l,separate" help:"directories where to find lua files with require(), automatically includes SITEDIR"`
 	RunTag []string `arg:"-t,separate" help:"runtime tags to include in the lua environment"`
+	Theme  []string `arg:"separate" help:"theme directory with files that SITEDIR can override, later themes override the earlier ones"`
+
+	PrettyURLs *bool  `help:"serve and build pages as directories, such that /about.html.lua is at /about/"`
+	BasePath   string `help:"URL path where the site is deployed, such as /docs for https://example.org/docs/"`
+
+	Timeout *time.Duration `help:"time limit for rendering a single page when serving or building, 0 for no limit [default: 30s]"`
 
 	Version bool `arg:"-v" help:"show version number"`
 }
@@ -74,6 +112,14 @@ func showHelp(parser *arg.Parser) {
 		println()
 		println(args.Run.Epilogue())
 	}
+	if args.Config != nil {
+		println()
+		println(args.Config.Epilogue())
+	}
+	if args.Init != nil {
+		println()
+		println(args.Init.Epilogue())
+	}
 	os.Exit(0)
 }
 
@@ -96,16 +142,25 @@ func ExecuteCLI() {
 		}
 	}
 
-	for _, p := range args.LuaDir {
-		if !lo.Must(fsStat(p)).IsDir() {
-			println("error: luadir must be a DIRECTORY")
-			os.Exit(-1)
+	var cfg Config
+	var configFile string
+	if siteDir, ok := cliSiteDir(); ok {
+		var err error
+		cfg, configFile, err = loadCLIConfig(siteDir)
+		if err != nil {
+			println("error:", err.Error())
+			os.Exit(1)
+		}
+		if err := moontpl.ApplyConfig(cfg); err != nil {
+			println("error:", err.Error())
+			os.Exit(1)
+		}
+		// the config file is not a part of the site
+		if configFile != "" && filepath.Dir(configFile) == siteDir {
+			moontpl.ignorePatterns = append(moontpl.ignorePatterns, filepath.Base(configFile))
 		}
-		moontpl.AddLuaDir(mustAbs(p))
 	}
 
-	moontpl.AddRunTags(args.RunTag...)
-
 	switch {
 	default:
 		showHelp(p)
@@ -151,21 +206,30 @@ func ExecuteCLI() {
 			}
 		}
 
+	case args.Config != nil:
+		if configFile != "" {
+			fmt.Printf("# config file: %s\n\n", configFile)
+		} else {
+			fmt.Print("# no config file found\n\n")
+		}
+		encoder := toml.NewEncoder(os.Stdout)
+		encoder.Indent = ""
+		if err := encoder.Encode(cfg); err != nil {
+			println("error:", err.Error())
+			os.Exit(1)
+		}
+
+	case args.Init != nil:
+		if err := createSiteFromTemplate(args.Init.Template, args.Init.Dir, args.Init.Force); err != nil {
+			println("error:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("created a %s site in %s, to preview it, run:\n  moontpl serve %s\n", args.Init.Template, args.Init.Dir, args.Init.Dir)
+
 	case args.Run != nil:
 		{
 			moontpl.Command = CommandRun
-
-			if args.Run.SiteDir != "" {
-				moontpl.SiteDir = lo.Must(filepath.Abs(args.Run.SiteDir))
-			} else {
-				path := mustRel(mustGetwd(), mustAbs(args.Run.Filename))
-				subDir, found := findFirstSubDirWithLuaFile(path)
-				if found {
-					moontpl.SiteDir = mustAbs(subDir)
-				} else {
-					moontpl.SiteDir = mustAbs(filepath.Dir(args.Run.Filename))
-				}
-			}
+			moontpl.SiteDir, _ = cliSiteDir()
 
 			if filepath.Ext(args.Run.Filename) != ".lua" && !args.Run.Force {
 				println("file must have a .lua file extension")
@@ -176,7 +240,7 @@ func ExecuteCLI() {
 				output, err := moontpl.RenderFile(args.Run.Filename)
 
 				if err != nil {
-					log.Println(err)
+					printRenderError(err, "")
 				} else {
 					fmt.Println(output)
 				}
@@ -221,7 +285,7 @@ func ExecuteCLI() {
 			moontpl.AddLuaDir(moontpl.SiteDir)
 			moontpl.AddRunTags("build")
 
-			outputDir := lo.Must(filepath.Abs(args.Build.OutputDir))
+			outputDir := mustAbs(cfg.Build.OutputDir)
 
 			if !args.Build.Test {
 				if !isDirectory(moontpl.SiteDir) {
@@ -251,9 +315,59 @@ func ExecuteCLI() {
 
 			moontpl.builder.testBuild = args.Build.Test
 			moontpl.builder.printOutput = args.Build.Print
+			moontpl.builder.force = args.Build.Force
+			moontpl.builder.failFast = args.Build.FailFast
+			moontpl.builder.checkLinks = args.Build.CheckLinks
+
+			if args.Build.Sitemap {
+				if moontpl.SiteURL == "" {
+					println("error: --sitemap requires --siteurl")
+					os.Exit(1)
+				}
+				moontpl.EnableSitemap(args.Build.Robots)
+			}
+			if args.Build.Fingerprint {
+				moontpl.EnableFingerprints()
+			}
+			moontpl.SetBuildJobs(args.Build.Jobs)
 
 			if err := moontpl.BuildAll(outputDir); err != nil {
-				println("error:", err.Error())
+				printBuildErrors(err)
+				os.Exit(1)
+			}
+
+			if args.Build.Clean && !args.Build.Test {
+				removed, err := moontpl.CleanOutputDir(outputDir, args.Build.DryRun)
+				if err != nil {
+					println("error:", err.Error())
+					os.Exit(1)
+				}
+				if args.Build.DryRun {
+					for _, filename := range removed {
+						fmt.Println("stale:", mustRel(mustGetwd(), filename))
+					}
+				}
+			}
+		}
+
+	case args.Check != nil:
+		{
+			moontpl.Command = CommandBuild
+			moontpl.SiteDir = lo.Must(filepath.Abs(args.Check.SiteDir))
+			moontpl.AddLuaDir(moontpl.SiteDir)
+			moontpl.AddRunTags("build", "check")
+
+			if !isDirectory(moontpl.SiteDir) {
+				println("error: SITEDIR must be a directory")
+				os.Exit(1)
+			}
+
+			moontpl.builder.testBuild = true
+			moontpl.builder.checkLinks = true
+
+			if err := moontpl.BuildAll(""); err != nil {
+				printBuildErrors(err)
+				os.Exit(1)
 			}
 		}
 
@@ -266,10 +380,10 @@ func ExecuteCLI() {
 
 			moontpl.fsWatcher.On(func(filename string) {
 				var modname string
-				if !isSubDirectory(moontpl.SiteDir, filename) {
-					filename = path.Base(filename)
-					modname = getModuleName(moontpl.SiteDir, filename)
+				if dir, ok := moontpl.layerDirOf(filename); ok {
+					modname = getModuleName(dir, filename)
 				} else {
+					filename = path.Base(filename)
 					modname = getModuleName(moontpl.SiteDir, filename)
 				}
 
@@ -283,10 +397,161 @@ func ExecuteCLI() {
 			}
 
 			_ = moontpl.startFsWatch()
-			moontpl.Serve("localhost:" + strconv.Itoa(args.Serve.Port))
+			defer moontpl.stopFsWatch()
+
+			go func() {
+				ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+				defer stop()
+				<-ctx.Done()
+				stop()
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := moontpl.Shutdown(ctx); err != nil {
+					println("error:", err.Error())
+				}
+			}()
+
+			if err := moontpl.Serve("localhost:" + strconv.Itoa(cfg.Serve.Port)); err != nil {
+				println("error:", err.Error())
+				os.Exit(1)
+			}
+		}
+	}
+
+}
+
+// cliSiteDir returns the SITEDIR of the command, which is
+// inferred from the filename for the run command.
+func cliSiteDir() (string, bool) {
+	switch {
+	case args.Build != nil:
+		return mustAbs(args.Build.SiteDir), true
+	case args.Serve != nil:
+		return mustAbs(args.Serve.SiteDir), true
+	case args.Check != nil:
+		return mustAbs(args.Check.SiteDir), true
+	case args.Config != nil:
+		return mustAbs(args.Config.SiteDir), true
+	case args.Run != nil:
+		if args.Run.SiteDir != "" {
+			return mustAbs(args.Run.SiteDir), true
+		}
+		path := mustRel(mustGetwd(), mustAbs(args.Run.Filename))
+		if subDir, found := findFirstSubDirWithLuaFile(path); found {
+			return mustAbs(subDir), true
 		}
+		return mustAbs(filepath.Dir(args.Run.Filename)), true
 	}
+	return "", false
+}
 
+// loadCLIConfig reads the config file found in SITEDIR or in the CWD,
+// and overrides it with the flags that are set.
+func loadCLIConfig(siteDir string) (Config, string, error) {
+	var cfg Config
+	configFile, found := FindConfigFile(siteDir, mustGetwd())
+	if found {
+		var err error
+		if cfg, err = LoadConfig(configFile); err != nil {
+			return cfg, configFile, err
+		}
+	}
+
+	for _, p := range args.LuaDir {
+		cfg.LuaDirs = append(cfg.LuaDirs, mustAbs(p))
+	}
+	for _, p := range args.Theme {
+		cfg.Themes = append(cfg.Themes, mustAbs(p))
+	}
+	cfg.RunTags = append(cfg.RunTags, args.RunTag...)
+
+	if args.PrettyURLs != nil {
+		cfg.PrettyURLs = *args.PrettyURLs
+	}
+	if args.BasePath != "" {
+		cfg.BasePath = args.BasePath
+	}
+	if args.Timeout != nil {
+		cfg.Timeout = args.Timeout.String()
+	}
+
+	if b := args.Build; b != nil {
+		if b.OutputDir != "" {
+			cfg.Build.OutputDir = mustAbs(b.OutputDir)
+		}
+		if b.CopyFiles != nil {
+			cfg.Build.CopyFiles = b.CopyFiles
+		}
+		if b.CopySource != nil {
+			cfg.Build.CopySource = *b.CopySource
+		}
+		if b.Minify != nil {
+			cfg.Build.Minify = *b.Minify
+		}
+		if b.SiteURL != "" {
+			cfg.SiteURL = b.SiteURL
+		}
+	} else if args.Config == nil {
+		// only minify the built files
+		cfg.Build.Minify = false
+	}
+
+	if s := args.Serve; s != nil && s.Port != nil {
+		cfg.Serve.Port = *s.Port
+	}
+
+	return cfg.WithDefaults(), configFile, nil
+}
+
+func printBuildErrors(err error) {
+	var errs BuildErrors
+	if !errors.As(err, &errs) {
+		println("error:", err.Error())
+		return
+	}
+
+	println()
+	println("error:", errs.Error())
+	for _, e := range errs {
+		var renderErr *RenderError
+		if errors.As(e, &renderErr) {
+			printRenderError(renderErr, "  ")
+			continue
+		}
+		e := *e
+		e.Source = displayPath(e.Source)
+		println("  " + e.Error())
+	}
+}
+
+// printRenderError prints the lua error and its traceback
+// in a file:line: message form that editors can jump to.
+func printRenderError(err error, indent string) {
+	var renderErr *RenderError
+	if !errors.As(err, &renderErr) {
+		println(indent + "error: " + err.Error())
+		return
+	}
+
+	e := *renderErr
+	e.Module = displayPath(e.Module)
+	println(indent + e.Error())
+
+	for i, frame := range e.Frames {
+		if i == 0 && frame.File == renderErr.Module && frame.Line == renderErr.Line {
+			continue
+		}
+		println(indent + "  " + displayPath(frame.File) + ":" + strconv.Itoa(frame.Line) + ": in " + frame.Function)
+	}
+}
+
+// displayPath makes the filename relative to the working directory, if it exists.
+func displayPath(filename string) string {
+	if filepath.IsAbs(filename) && fsExists(filename) {
+		return mustRel(mustGetwd(), filename)
+	}
+	return filename
 }
 
 func findFirstSubDirWithLuaFile(path string) (string, bool) {
@@ -0,0 +1,199 @@
+package moontpl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ConfigFilenames are the names of the project config file,
+// in the order they are looked for in a directory.
+var ConfigFilenames = []string{"moontpl.toml", "moontpl.lua"}
+
+const (
+	defaultOutputDir = "output"
+	defaultPort      = 9876
+	defaultTimeout   = "30s"
+)
+
+// Config is the project configuration, read from moontpl.toml or moontpl.lua.
+// A moontpl.lua file returns a table with the same keys as moontpl.toml.
+// The zero values are the defaults, see WithDefaults.
+type Config struct {
+	// LuaDirs are the directories where require() finds lua files.
+	LuaDirs []string `toml:"luadirs" luar:"luadirs"`
+	RunTags []string `toml:"runtags" luar:"runtags"`
+	Themes  []string `toml:"themes" luar:"themes"`
+
+	// Ignore are the patterns of the site files that are not rendered,
+	// copied, served or listed. A pattern without a slash, like *.bak,
+	// matches the name of a file or directory anywhere in the site,
+	// otherwise it matches the path from the site root, like /drafts
+	// or drafts/*.
+	Ignore []string `toml:"ignore" luar:"ignore"`
+
+	SiteURL    string `toml:"siteurl" luar:"siteurl"`
+	BasePath   string `toml:"basepath" luar:"basepath"`
+	PrettyURLs bool   `toml:"prettyurls" luar:"prettyurls"`
+
+	// Timeout is the time limit for rendering a single page, such as 30s.
+	Timeout string `toml:"timeout" luar:"timeout"`
+
+	Build BuildConfig `toml:"build" luar:"build"`
+	Serve ServeConfig `toml:"serve" luar:"serve"`
+
+	// Site is the site-wide metadata, such as the title and the author,
+	// which is available in lua as require("site").data.
+	Site map[string]any `toml:"site" luar:"site"`
+}
+
+type BuildConfig struct {
+	OutputDir string `toml:"output" luar:"output"`
+
+	// CopyFiles copies the static files, such as images, into the output.
+	CopyFiles *bool `toml:"copyfiles" luar:"copyfiles"`
+	// CopySource also copies the lua source files into the output.
+	CopySource bool `toml:"copysource" luar:"copysource"`
+
+	Minify bool `toml:"minify" luar:"minify"`
+}
+
+type ServeConfig struct {
+	Port int `toml:"port" luar:"port"`
+}
+
+// FindConfigFile returns the first config file found in the directories.
+func FindConfigFile(dirs ...string) (string, bool) {
+	for _, dir := range dirs {
+		for _, name := range ConfigFilenames {
+			filename := filepath.Join(dir, name)
+			if stat, err := os.Stat(filename); err == nil && !stat.IsDir() {
+				return filename, true
+			}
+		}
+	}
+	return "", false
+}
+
+// LoadConfig reads the config file, relative paths in
+// the file are resolved from the directory of the file.
+func LoadConfig(filename string) (Config, error) {
+	var cfg Config
+
+	switch filepath.Ext(filename) {
+	case ".toml":
+		meta, err := toml.DecodeFile(filename, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid config file %s: %w", filename, err)
+		}
+		for _, key := range meta.Undecoded() {
+			// the site table can have any keys
+			if key[0] != "site" {
+				return cfg, fmt.Errorf("invalid config file %s: unknown key %s", filename, key)
+			}
+		}
+
+	case ".lua":
+		L := lua.NewState()
+		defer L.Close()
+
+		if err := L.DoFile(filename); err != nil {
+			return cfg, err
+		}
+		if err := FromLuaInto(L.Get(-1), &cfg); err != nil {
+			return cfg, fmt.Errorf("invalid config file %s: %w", filename, err)
+		}
+
+	default:
+		return cfg, fmt.Errorf("unknown config file type: %s", filename)
+	}
+
+	dir := filepath.Dir(mustAbs(filename))
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	for i := range cfg.LuaDirs {
+		cfg.LuaDirs[i] = resolve(cfg.LuaDirs[i])
+	}
+	for i := range cfg.Themes {
+		cfg.Themes[i] = resolve(cfg.Themes[i])
+	}
+	cfg.Build.OutputDir = resolve(cfg.Build.OutputDir)
+
+	return cfg, nil
+}
+
+// WithDefaults returns the config with the defaults for the unset options.
+func (cfg Config) WithDefaults() Config {
+	if cfg.Timeout == "" {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.Build.OutputDir == "" {
+		cfg.Build.OutputDir = defaultOutputDir
+	}
+	if cfg.Build.CopyFiles == nil {
+		copyFiles := true
+		cfg.Build.CopyFiles = &copyFiles
+	}
+	if cfg.Serve.Port == 0 {
+		cfg.Serve.Port = defaultPort
+	}
+	if cfg.Site == nil {
+		cfg.Site = map[string]any{}
+	}
+	return cfg
+}
+
+// ApplyConfig sets the options of the config. The output directory
+// and the port are not used here, they are passed to BuildAll and Serve.
+func (m *Moontpl) ApplyConfig(cfg Config) error {
+	cfg = cfg.WithDefaults()
+
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+	for _, pattern := range cfg.Ignore {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid ignore pattern %s: %w", pattern, err)
+		}
+	}
+	for _, dir := range slices.Concat(cfg.LuaDirs, cfg.Themes) {
+		if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+			return errors.New("not a directory: " + dir)
+		}
+	}
+
+	for _, dir := range cfg.LuaDirs {
+		m.AddLuaDir(dir)
+	}
+	for _, dir := range cfg.Themes {
+		m.AddTheme(dir)
+	}
+	m.AddRunTags(cfg.RunTags...)
+	if cfg.Build.Minify {
+		m.AddRunTags(minifyRunTag)
+	}
+
+	m.ignorePatterns = append(m.ignorePatterns, cfg.Ignore...)
+	m.SiteURL = cfg.SiteURL
+	m.BasePath = cfg.BasePath
+	m.PrettyURLs = cfg.PrettyURLs
+	m.RenderTimeout = timeout
+	m.SiteData = cfg.Site
+
+	m.builder.copyStaticFiles = *cfg.Build.CopyFiles
+	m.builder.copyLuaSourceFiles = cfg.Build.CopySource
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package moontpl
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+//go:embed templates
+var siteTemplates embed.FS
+
+// luaLibraryDir is where init copies the lua modules,
+// so that the editors can find the type annotations.
+const luaLibraryDir = ".moontpl/lua"
+
+type initCmd struct {
+	Template string `arg:"required,positional" help:"name of the site template"`
+	Dir      string `arg:"required,positional" help:"directory where the site will be created"`
+	Force    bool   `arg:"-f" help:"overwrite existing files" default:"false"`
+}
+
+func (*initCmd) Epilogue() string {
+	return `Templates:
+  minimal   a single page and a stylesheet
+  blog      posts with a layout, an index and an Atom feed
+  docs      documentation pages with a sidebar
+
+Besides the template files, a .luarc.json and the moontpl lua modules
+in .moontpl/lua are written, so that the lua language server knows
+about the moontpl modules and globals.
+`
+}
+
+// templateNames returns the names of the built-in site templates.
+func templateNames() []string {
+	entries, _ := siteTemplates.ReadDir("templates")
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// createSiteFromTemplate writes the files of the template into dir.
+// Existing files are only overwritten if force is true,
+// otherwise nothing is written.
+func createSiteFromTemplate(name, dir string, force bool) error {
+	templateDir := path.Join("templates", name)
+	if stat, err := fs.Stat(siteTemplates, templateDir); err != nil || !stat.IsDir() {
+		return fmt.Errorf("unknown template %q, available templates are: %s", name, strings.Join(templateNames(), ", "))
+	}
+
+	files := map[string][]byte{}
+	addFiles := func(fsys fs.FS, root, destDir string) error {
+		return fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := fs.ReadFile(fsys, p)
+			if err != nil {
+				return err
+			}
+			files[path.Join(destDir, strings.TrimPrefix(p, root+"/"))] = data
+			return nil
+		})
+	}
+	if err := addFiles(siteTemplates, templateDir, "."); err != nil {
+		return err
+	}
+	if err := addFiles(embedded, "lua", luaLibraryDir); err != nil {
+		return err
+	}
+	luarc, err := createLuarc()
+	if err != nil {
+		return err
+	}
+	files[".luarc.json"] = luarc
+
+	filenames := make([]string, 0, len(files))
+	for name := range files {
+		filenames = append(filenames, name)
+	}
+	sort.Strings(filenames)
+
+	if !force {
+		var existing []string
+		for _, name := range filenames {
+			if fsExists(filepath.Join(dir, filepath.FromSlash(name))) {
+				existing = append(existing, name)
+			}
+		}
+		if len(existing) > 0 {
+			return errors.New("files already exist in " + dir + ", use --force to overwrite:\n  " + strings.Join(existing, "\n  "))
+		}
+	}
+
+	for _, name := range filenames {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filename, files[name], 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createLuarc returns the .luarc.json for the lua language server,
+// with the moontpl modules in the library and the globals of
+// require("web"), such as DIV, so they are not reported as undefined.
+func createLuarc() ([]byte, error) {
+	L := lua.NewState()
+	stdGlobals := luaGlobalNames(L)
+	L.Close()
+
+	L = New().createState()
+	defer L.Close()
+	if err := L.DoString(`require("web")`); err != nil {
+		return nil, err
+	}
+	var globals []string
+	for name := range luaGlobalNames(L) {
+		if !stdGlobals[name] {
+			globals = append(globals, name)
+		}
+	}
+	sort.Strings(globals)
+
+	data, err := json.MarshalIndent(map[string]any{
+		"$schema":             "https://raw.githubusercontent.com/LuaLS/vscode-lua/master/setting/schema.json",
+		"runtime.version":     "Lua 5.1",
+		"workspace.library":   []string{luaLibraryDir},
+		"diagnostics.globals": globals,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func luaGlobalNames(L *lua.LState) map[string]bool {
+	names := map[string]bool{}
+	L.G.Global.ForEach(func(k, _ lua.LValue) {
+		if name, ok := k.(lua.LString); ok {
+			names[string(name)] = true
+		}
+	})
+	return names
+}
@@ -1,12 +1,19 @@
 package moontpl
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
 )
 
 type Link string
@@ -15,100 +22,372 @@ type Filename string
 type siteBuilder struct {
 	testBuild   bool
 	printOutput bool
+	force       bool
+	failFast    bool
+	checkLinks  bool
+	sitemap     bool
+	robots      bool
+	fingerprint bool
+	jobs        int
 	done        map[Link]bool
 	buildQueue  []Link
 
+	// links queued by build.queue() while a page is being rendered,
+	// keyed by the lua state that renders the page.
+	// These are added to the buildQueue after the render finishes,
+	// in the same order the pages were queued,
+	// so that the build order stays the same regardless of the number of jobs.
+	pending map[*lua.LState][]Link
+	mu      sync.Mutex
+
+	// manifest is the build manifest of the previous build,
+	// nextManifest is the one that will be written after the current build.
+	manifest     *buildManifest
+	nextManifest *buildManifest
+	hashes       map[string]string
+
+	// produced contains the absolute filenames of
+	// the files written by the last build
+	produced map[string]struct{}
+
+	// finishedDir is the output directory of the last build if it
+	// finished without errors. Otherwise, produced is incomplete
+	// and the output directory can't be cleaned.
+	finishedDir string
+
+	linkChecker    *linkChecker
+	sitemapEntries map[Link]*sitemapURL
+
+	// assets maps the links of the fingerprinted files
+	// to their fingerprinted links, such as /style.css -> /style.3f9a2c1b.css
+	assets map[string]string
+
+	copyStaticFiles    bool
 	copyLuaSourceFiles bool
 }
 
+type buildJob struct {
+	link    Link
+	src     string
+	dest    string
+	output  string
+	queued  []Link
+	deps    map[string]string
+	links   *pageLinks
+	sitemap *sitemapURL
+	skipped bool
+	err     error
+
+	// cancelled is set when the render was stopped by the RenderTimeout,
+	// or by a panic, after which the lua state can't be reused
+	cancelled bool
+}
+
 func newSiteBuilder() *siteBuilder {
 	builder := &siteBuilder{
+		jobs:       1,
 		done:       map[Link]bool{},
 		buildQueue: []Link{},
+		pending:    map[*lua.LState][]Link{},
+		hashes:     map[string]string{},
+		produced:   map[string]struct{}{},
+		assets:     map[string]string{},
+
+		copyStaticFiles: true,
 	}
 	return builder
 }
 
-func (m *Moontpl) queueLink(link string) {
-	if !m.builder.done[Link(link)] {
-		m.builder.buildQueue = append(m.builder.buildQueue, Link(link))
+// SetBuildJobs sets the number of pages that are rendered in parallel
+// by BuildAll. If n <= 0, the number of CPUs is used.
+func (m *Moontpl) SetBuildJobs(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
 	}
+	m.builder.jobs = n
 }
 
-func (m *Moontpl) build(src, dest string) error {
-	L := m.getState(src)
-	defer m.putState(L)
+func (m *Moontpl) queueLink(L *lua.LState, link string) {
+	if i := strings.Index(link, "#"); i >= 0 {
+		link = link[:i]
+	}
+	link = m.pageLinkFromURL(m.stripBasePath(link))
 
-	output, err := m.RenderFile(src)
-	if err != nil {
-		return err
+	b := m.builder
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.done[Link(link)] {
+		return
 	}
+	if queued, ok := b.pending[L]; ok {
+		b.pending[L] = append(queued, Link(link))
+	} else {
+		b.buildQueue = append(b.buildQueue, Link(link))
+	}
+}
 
-	if !m.builder.testBuild {
-		log.Print("exec ", mustRel(mustGetwd(), src), " -> ", mustRel(mustGetwd(), dest))
+func (m *Moontpl) build(L *lua.LState, job *buildJob) {
+	b := m.builder
+
+	b.mu.Lock()
+	b.pending[L] = []Link{}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		job.queued = b.pending[L]
+		delete(b.pending, L)
+		b.mu.Unlock()
+	}()
+
+	// a lua error raised outside of a protected call, such as when
+	// the page broke the page module, only fails this job
+	defer func() {
+		if r := recover(); r != nil {
+			job.err = newRenderError(job.src, recoveredError(r))
+			job.cancelled = true
+		}
+	}()
 
-		// ignore error
-		_ = os.MkdirAll(filepath.Dir(dest), 0755)
+	m.resetPageState(L, job.src)
+
+	isHTML := strings.HasSuffix(job.src, ".html.lua")
 
-		if err := os.WriteFile(dest, []byte(output), 0644); err != nil {
-			panic(err)
+	// the output is only kept in memory when it's needed after the build
+	var output strings.Builder
+	keepOutput := b.printOutput || (b.checkLinks && isHTML) || (b.fingerprint && !isHTML)
+
+	render := func(w io.Writer) error {
+		if keepOutput {
+			w = io.MultiWriter(w, &output)
 		}
+		ctx, cancel := m.renderTimeoutContext(context.Background())
+		defer cancel()
+
+		var err error
+		if !runWithContext(ctx, L, func() { err = m.renderTo(L, w, job.src, RenderOptions{}) }) {
+			job.cancelled = true
+		}
+		return renderContextError(ctx, job.src, err)
+	}
+
+	if b.testBuild {
+		job.err = render(io.Discard)
+	} else {
+		// ignore error
+		_ = os.MkdirAll(filepath.Dir(job.dest), 0755)
+		job.err = writeFileWith(job.dest, render)
+	}
+	if job.err != nil {
+		return
+	}
+
+	if b.printOutput || (b.fingerprint && !isHTML) {
+		job.output = output.String()
+	}
+
+	if b.checkLinks && isHTML {
+		job.links = scanHTMLLinks([]byte(output.String()))
+	}
+
+	if b.sitemap && strings.HasSuffix(job.src, ".html.lua") {
+		job.sitemap = m.getSitemapData(L, job.src)
+	}
+
+	if b.nextManifest != nil {
+		job.deps = m.collectDependencies(L, job.src)
+	}
+}
+
+// runBuildJobs renders the jobs on a pool of workers,
+// each worker holding its own lua state.
+// The results are stored in each job.
+func (m *Moontpl) runBuildJobs(jobs []*buildJob) {
+	for _, job := range jobs {
+		job.skipped = m.isUpToDate(job)
+	}
+
+	n := min(max(m.builder.jobs, 1), len(jobs))
+	jobChan := make(chan *buildJob)
+
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			L := m.getState("-")
+			defer func() { m.putState(L) }()
+
+			for job := range jobChan {
+				if !job.skipped {
+					m.build(L, job)
+				}
+				if job.cancelled {
+					// the render was stopped midway, so the state can't be reused
+					L.Close()
+					L = m.getState("-")
+				}
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		jobChan <- job
+	}
+	close(jobChan)
+	wg.Wait()
+}
+
+// finishBuildJob logs the job result and records it in the manifest.
+// This is done after all the jobs are finished so that
+// the log order is deterministic.
+func (m *Moontpl) finishBuildJob(job *buildJob) *BuildError {
+	if job.err != nil {
+		log.Print("fail ", mustRel(mustGetwd(), job.src))
+		return newBuildError(string(job.link), job.src, job.err)
+	}
+
+	m.addProducedFile(job.dest)
+
+	if job.skipped {
+		log.Print("skip ", mustRel(mustGetwd(), job.src), " (unchanged)")
+	} else if !m.builder.testBuild {
+		log.Print("exec ", mustRel(mustGetwd(), job.src), " -> ", mustRel(mustGetwd(), job.dest))
 	}
 
 	if m.builder.printOutput {
-		header := "---------[" + src + "]---------"
+		header := "---------[" + job.src + "]---------"
 		println(header)
-		println(output)
+		println(job.output)
 		println(strings.Repeat("-", len(header)))
 		println()
 	}
 
-	return nil
-}
-
-func (m *Moontpl) BuildAll(outputDir string) error {
-	defer clear(m.builder.done)
+	if lc := m.builder.linkChecker; lc != nil {
+		if !strings.HasSuffix(job.src, ".html.lua") {
+			lc.addTarget(string(job.link))
+		} else {
+			links := job.links
+			if job.skipped {
+				contents, err := os.ReadFile(job.dest)
+				if err != nil {
+					return newBuildError(string(job.link), job.dest, err)
+				}
+				links = scanHTMLLinks(contents)
+			}
+
+			_, source := extractPathParams(job.src)
+			lc.addPage(m.outputFile(string(job.link)), source, links)
+		}
+	}
 
-	filenames, err := m.GetPageFilenames(m.SiteDir)
-	if err != nil {
-		return err
+	if job.sitemap != nil {
+		m.builder.sitemapEntries[job.link] = job.sitemap
 	}
-	for _, p := range filenames {
-		m.queueLink(p.Link)
+
+	if next := m.builder.nextManifest; next != nil {
+		next.Pages[job.link] = &manifestEntry{
+			Dependencies: job.deps,
+			Queued:       job.queued,
+			Sitemap:      job.sitemap,
+		}
 	}
 
-	for len(m.builder.buildQueue) > 0 {
-		linkWithParams := m.builder.buildQueue[0]
+	return nil
+}
+
+// nextPageJobs takes all the links in the build queue
+// that haven't been built yet.
+func (m *Moontpl) nextPageJobs(outputDir string) []*buildJob {
+	b := m.builder
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var jobs []*buildJob
+	for _, linkWithParams := range b.buildQueue {
 		hashIndex := strings.Index(string(linkWithParams), "#")
 		if hashIndex >= 0 {
 			linkWithParams = linkWithParams[0:hashIndex]
 		}
 
-		m.builder.buildQueue = m.builder.buildQueue[1:]
-
-		if _, ok := m.builder.done[linkWithParams]; ok {
+		if _, ok := b.done[linkWithParams]; ok {
 			continue
 		}
+		b.done[linkWithParams] = true
 
 		src := filepath.Join(m.SiteDir, string(linkWithParams)+".lua")
-		dest := filepath.Join(outputDir, string(linkWithParams))
+		dest := filepath.Join(outputDir, m.outputFile(string(linkWithParams)))
 
 		_, actualFilename := extractPathParams(src)
-		if !fsExists(actualFilename) {
+		if !m.siteFileExists(actualFilename) {
 			log.Printf("LINK NOT FOUND: %s", linkWithParams)
 		}
 
-		if err := m.build(src, dest); err != nil {
-			panic(err)
+		jobs = append(jobs, &buildJob{link: linkWithParams, src: src, dest: dest})
+	}
+	b.buildQueue = b.buildQueue[:0]
+
+	return jobs
+}
+
+// BuildAll renders all the pages and files in the SITEDIR into the outputDir.
+// A failed page doesn't stop the build (unless fail-fast is set), instead
+// all the failures are returned together as BuildErrors.
+func (m *Moontpl) BuildAll(outputDir string) error {
+	b := m.builder
+	var errs BuildErrors
+	defer clear(b.done)
+
+	b.hashes = map[string]string{}
+	b.produced = map[string]struct{}{}
+	b.finishedDir = ""
+	b.linkChecker = nil
+	b.sitemapEntries = map[Link]*sitemapURL{}
+	b.assets = map[string]string{}
+	if b.checkLinks {
+		b.linkChecker = newLinkChecker(m.basePath())
+	}
+
+	if !b.testBuild {
+		if err := m.markOutputDir(outputDir); err != nil {
+			return err
+		}
+
+		settings := m.buildSettings()
+		if !b.force {
+			b.manifest = readBuildManifest(outputDir, settings)
 		}
+		b.nextManifest = newBuildManifest(settings)
 
-		m.builder.done[linkWithParams] = true
+		defer func() {
+			b.manifest = nil
+			b.nextManifest = nil
+		}()
+	}
+
+	// The assets (static files and non-HTML outputs such as .css.lua)
+	// are built first, so that their fingerprinted names
+	// are known when the pages are rendered.
+	if !b.testBuild {
+		if err := m.CopyNonSourceFiles(m.SiteDir, outputDir); err != nil {
+			var copyErrs BuildErrors
+			if errors.As(err, &copyErrs) {
+				errs = append(errs, copyErrs...)
+			} else {
+				errs = append(errs, newBuildError("", "", err))
+			}
+			if b.failFast {
+				return errs
+			}
+		}
 	}
 
 	plainFiles, err := m.getNonHtmlLuaFilenames(m.SiteDir)
 	if err != nil {
 		return err
 	}
+	var jobs []*buildJob
 	for _, p := range plainFiles {
 		src := filepath.Join(m.SiteDir, string(p.Link)+".lua")
 		dest := filepath.Join(outputDir, string(p.Link))
@@ -119,56 +398,155 @@ func (m *Moontpl) BuildAll(outputDir string) error {
 			continue
 		}
 
-		if err := m.build(src, dest); err != nil {
-			panic(err)
+		jobs = append(jobs, &buildJob{link: Link(p.Link), src: src, dest: dest})
+	}
+
+	m.runBuildJobs(jobs)
+	for _, job := range jobs {
+		if err := m.finishBuildJob(job); err != nil {
+			errs = append(errs, err)
+			if b.failFast {
+				return errs
+			}
+			continue
+		}
+		if b.fingerprint {
+			if err := m.fingerprintJob(outputDir, job); err != nil {
+				errs = append(errs, newBuildError(string(job.link), job.src, err))
+			}
 		}
 	}
 
-	if !m.builder.testBuild {
-		if err := m.CopyNonSourceFiles(m.SiteDir, outputDir); err != nil {
-			return err
+	// the non-HTML outputs may have read the assets before their own
+	// fingerprints were added, the pages must see all the assets
+	b.mu.Lock()
+	delete(b.hashes, assetsDependency)
+	b.mu.Unlock()
+
+	filenames, err := m.GetPageFilenames(m.SiteDir)
+	if err != nil {
+		return err
+	}
+	for _, p := range filenames {
+		m.queueLink(nil, p.Link)
+	}
+
+	for {
+		jobs := m.nextPageJobs(outputDir)
+		if len(jobs) == 0 {
+			break
+		}
+
+		m.runBuildJobs(jobs)
+
+		for _, job := range jobs {
+			if err := m.finishBuildJob(job); err != nil {
+				errs = append(errs, err)
+				if b.failFast {
+					return errs
+				}
+				continue
+			}
+			b.buildQueue = append(b.buildQueue, job.queued...)
+		}
+	}
+
+	if !b.testBuild {
+		if b.sitemap {
+			if err := m.writeSitemap(outputDir, b.sitemapEntries); err != nil {
+				errs = append(errs, newBuildError("", "", err))
+			}
+		}
+		if err := b.nextManifest.write(outputDir); err != nil {
+			errs = append(errs, newBuildError("", "", err))
+		}
+	}
+
+	if lc := b.linkChecker; lc != nil {
+		if err := lc.addStaticFiles(m.siteFS(), b.copyStaticFiles, b.copyLuaSourceFiles); err != nil {
+			errs = append(errs, newBuildError("", "", err))
 		}
+		errs = append(errs, lc.check()...)
+	}
+
+	if len(errs) > 0 {
+		return errs
 	}
 
+	b.finishedDir = mustAbs(outputDir)
 	return nil
 }
 
+// CopyNonSourceFiles copies the static files of the site into destDir.
+// A file that fails to copy doesn't stop the others (unless fail-fast
+// is set), the failures are returned together as BuildErrors.
 func (m *Moontpl) CopyNonSourceFiles(srcDir, destDir string) error {
-	return fs.WalkDir(os.DirFS(srcDir), ".", func(p string, dir fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+	var errs BuildErrors
+	err := m.walkSiteDir(srcDir, func(src string, dir fs.DirEntry) error {
 		if dir.IsDir() {
+			// the output can be next to the pages, as with moontpl build . public
+			if dir.Name() == manifestCacheDir {
+				return fs.SkipDir
+			}
 			return nil
 		}
-		if filepath.Ext(p) == ".lua" && !m.builder.copyLuaSourceFiles {
+		if isLua := filepath.Ext(src) == ".lua"; isLua && !m.builder.copyLuaSourceFiles || !isLua && !m.builder.copyStaticFiles {
 			return nil
 		}
 
-		src := filepath.Join(srcDir, p)
-		dest := filepath.Join(destDir, p)
+		if err := m.copyNonSourceFile(srcDir, destDir, src); err != nil {
+			errs = append(errs, newBuildError("", src, err))
+			if m.builder.failFast {
+				return fs.SkipAll
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, newBuildError("", "", err))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (m *Moontpl) copyNonSourceFile(srcDir, destDir, src string) error {
+	p := filepath.ToSlash(mustRel(srcDir, src))
+	dest := filepath.Join(destDir, p)
+	m.addProducedFile(dest)
+
+	unchanged := false
+	if next := m.builder.nextManifest; next != nil {
+		hash, ok := m.hashDependency(src)
+		if !ok {
+			return fmt.Errorf("failed to read %s", src)
+		}
+		next.Files[p] = hash
+
+		prev := m.builder.manifest
+		unchanged = prev != nil && prev.Files[p] == hash && fsExists(dest)
+	}
 
+	if !unchanged {
 		// ignore error
 		_ = os.MkdirAll(filepath.Dir(dest), 0755)
 
 		log.Print("copy ", mustRel(mustGetwd(), src), " -> ", mustRel(mustGetwd(), dest))
 
-		inputFile, err := os.Open(src)
-		if err != nil {
+		if err := m.copySiteFile(src, dest); err != nil {
 			return err
 		}
-		defer inputFile.Close()
-
-		outputFile, err := os.Create(dest)
-		if err != nil {
-			return err
-		}
-		defer outputFile.Close()
+	}
 
-		if _, err = io.Copy(outputFile, inputFile); err != nil {
-			return err
+	if m.builder.fingerprint && isFingerprintable("/"+p) {
+		hash, ok := m.hashDependency(src)
+		if !ok {
+			return fmt.Errorf("failed to read %s", src)
 		}
+		return m.fingerprintFile(destDir, "/"+p, hash)
+	}
 
-		return inputFile.Sync()
-	})
+	return nil
 }
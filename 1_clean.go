@@ -0,0 +1,110 @@
+package moontpl
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// The marker file is created in the output directory if the directory was
+// created (or was empty) on the first build. Output directories without
+// the marker will not be cleaned, since it could contain files
+// that are not from moontpl.
+const outputMarkerFilename = ".moontpl-output"
+
+// markOutputDir creates the marker file if the outputDir
+// is empty or doesn't exist yet.
+func (m *Moontpl) markOutputDir(outputDir string) error {
+	entries, err := os.ReadDir(outputDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outputDir, outputMarkerFilename), nil, 0644)
+}
+
+// addProducedFile records a file that was written,
+// or would have been written, by the current build.
+func (m *Moontpl) addProducedFile(filename string) {
+	b := m.builder
+	b.mu.Lock()
+	b.produced[mustAbs(filename)] = struct{}{}
+	b.mu.Unlock()
+}
+
+// CleanOutputDir removes the files in the outputDir that were
+// not produced by the last BuildAll, such as the output of
+// deleted pages. If dryRun is true, the files are only listed
+// and not removed. The removed (or to be removed) files are returned.
+//
+// The outputDir must have been created by BuildAll, and the last
+// BuildAll must have built it without errors, otherwise an error
+// is returned. This keeps the previous outputs of the failed pages.
+func (m *Moontpl) CleanOutputDir(outputDir string, dryRun bool) ([]string, error) {
+	outputDir = mustAbs(outputDir)
+	if !fsExists(filepath.Join(outputDir, outputMarkerFilename)) {
+		return nil, fmt.Errorf(
+			"refusing to clean %s: the directory was not created by moontpl (%s not found)",
+			outputDir, outputMarkerFilename,
+		)
+	}
+	if m.builder.finishedDir != outputDir {
+		return nil, fmt.Errorf("refusing to clean %s: the last build of the directory did not finish without errors", outputDir)
+	}
+
+	var stale []string
+	var dirs []string
+	err := fs.WalkDir(os.DirFS(outputDir), ".", func(p string, dir fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		filename := filepath.Join(outputDir, p)
+		if dir.IsDir() {
+			if p != "." {
+				dirs = append(dirs, filename)
+			}
+			return nil
+		}
+
+		switch p {
+		case outputMarkerFilename:
+			return nil
+		}
+		if _, ok := m.builder.produced[filename]; !ok {
+			stale = append(stale, filename)
+		}
+
+		return nil
+	})
+	if err != nil || dryRun {
+		return stale, err
+	}
+
+	for _, filename := range stale {
+		log.Print("remove ", mustRel(mustGetwd(), filename))
+		if err := os.Remove(filename); err != nil {
+			return stale, err
+		}
+	}
+
+	// remove the directories that became empty,
+	// starting from the deepest ones
+	slices.Reverse(dirs)
+	for _, dir := range dirs {
+		if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+			_ = os.Remove(dir)
+		}
+	}
+
+	return stale, nil
+}
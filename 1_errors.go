@@ -0,0 +1,216 @@
+package moontpl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// BuildError is the failure of a single page or file during BuildAll.
+type BuildError struct {
+	// Link is the page link, such as /dir/page.html.
+	// It's empty if the error isn't about a page.
+	Link string
+
+	// Source is the file where the error occurred, this can be
+	// a lua module instead of the page file itself.
+	Source string
+
+	// Line is the line number in Source, or 0 if unknown.
+	Line int
+
+	Message string
+	Err     error
+}
+
+func (e *BuildError) Error() string {
+	var buf strings.Builder
+	if e.Link != "" && e.Link != e.Source {
+		buf.WriteString(e.Link)
+		buf.WriteString(": ")
+	}
+	if e.Source != "" {
+		buf.WriteString(e.Source)
+		if e.Line > 0 {
+			buf.WriteString(":" + strconv.Itoa(e.Line))
+		}
+		buf.WriteString(": ")
+	}
+	buf.WriteString(e.Message)
+	return buf.String()
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// BuildErrors is returned by BuildAll when
+// one or more files failed to build, or when
+// broken links are found.
+type BuildErrors []*BuildError
+
+func (errs BuildErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	return fmt.Sprintf("build failed with %d errors", len(errs))
+}
+
+func (errs BuildErrors) Unwrap() []error {
+	result := make([]error, len(errs))
+	for i, err := range errs {
+		result[i] = err
+	}
+	return result
+}
+
+var (
+	luaErrorLocationRe  = regexp.MustCompile(`(?s)^(.+?):(\d+): (.*)$`)
+	luaSyntaxLocationRe = regexp.MustCompile(`(?s)^(.+?) line:(\d+)\(column:\d+\) (near .*)$`)
+)
+
+func newBuildError(link, source string, err error) *BuildError {
+	result := &BuildError{
+		Link:    link,
+		Source:  source,
+		Message: err.Error(),
+		Err:     err,
+	}
+
+	var renderErr *RenderError
+	if errors.As(err, &renderErr) {
+		result.Source = renderErr.Module
+		result.Line = renderErr.Line
+		result.Message = renderErr.Message
+		return result
+	}
+
+	var apiErr *lua.ApiError
+	if !errors.As(err, &apiErr) {
+		return result
+	}
+
+	message := strings.TrimSpace(apiErr.Object.String())
+	result.Message = message
+
+	for _, re := range []*regexp.Regexp{luaErrorLocationRe, luaSyntaxLocationRe} {
+		if m := re.FindStringSubmatch(message); m != nil {
+			result.Source = m[1]
+			result.Line, _ = strconv.Atoi(m[2])
+			result.Message = strings.TrimSpace(m[3])
+			break
+		}
+	}
+
+	return result
+}
+
+// RenderError is a lua error from rendering a page, with the
+// source locations taken from the lua traceback.
+type RenderError struct {
+	// Page is the filename of the page that was rendered.
+	Page string
+
+	// Module is the lua file where the error was raised,
+	// this can be a module required by the page.
+	Module string
+
+	// Line is the line number in Module, or 0 if unknown.
+	Line int
+
+	Message string
+
+	// Frames are the lua calls in the traceback, starting
+	// with the innermost one. Go functions are not included.
+	Frames []ErrorFrame
+
+	Err error
+}
+
+// ErrorFrame is a location in a lua traceback.
+type ErrorFrame struct {
+	File string
+	Line int
+
+	// Function describes the function at the location,
+	// such as "main chunk" or "function 'render'".
+	Function string
+}
+
+// Error returns the error in a compact file:line: message form.
+func (e *RenderError) Error() string {
+	if e.Module == "" {
+		return e.Message
+	}
+	if e.Line > 0 {
+		return e.Module + ":" + strconv.Itoa(e.Line) + ": " + e.Message
+	}
+	return e.Module + ": " + e.Message
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+var luaTracebackFrameRe = regexp.MustCompile(`^\s*(.+?):(\d+): in (.*)$`)
+
+// newRenderError converts a lua error into a RenderError.
+// Other errors are returned as is.
+func newRenderError(page string, err error) error {
+	var apiErr *lua.ApiError
+	if err == nil || !errors.As(err, &apiErr) {
+		return err
+	}
+	var renderErr *RenderError
+	if errors.As(err, &renderErr) {
+		return err
+	}
+
+	result := &RenderError{
+		Page:    page,
+		Message: strings.TrimSpace(apiErr.Object.String()),
+		Err:     err,
+	}
+
+	for _, re := range []*regexp.Regexp{luaErrorLocationRe, luaSyntaxLocationRe} {
+		if m := re.FindStringSubmatch(result.Message); m != nil {
+			result.Module = m[1]
+			result.Line, _ = strconv.Atoi(m[2])
+			result.Message = strings.TrimSpace(m[3])
+			break
+		}
+	}
+
+	for _, line := range strings.Split(apiErr.StackTrace, "\n") {
+		m := luaTracebackFrameRe.FindStringSubmatch(line)
+		if m == nil || strings.HasPrefix(m[1], "[G]") {
+			continue
+		}
+		lineNum, _ := strconv.Atoi(m[2])
+		function := m[3]
+		if function == "function <"+m[1]+":0>" {
+			// a file that's run from a go function, see protectedCall
+			function = "main chunk"
+		}
+		result.Frames = append(result.Frames, ErrorFrame{
+			File:     m[1],
+			Line:     lineNum,
+			Function: function,
+		})
+	}
+
+	// syntax errors have no traceback
+	if len(result.Frames) == 0 && result.Module != "" {
+		result.Frames = []ErrorFrame{{File: result.Module, Line: result.Line, Function: "main chunk"}}
+	}
+	if result.Module == "" && len(result.Frames) > 0 {
+		result.Module = result.Frames[0].File
+		result.Line = result.Frames[0].Line
+	}
+
+	return result
+}
@@ -0,0 +1,100 @@
+package moontpl
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fingerprintLength is the number of hash characters in a fingerprinted file name.
+const fingerprintLength = 8
+
+// EnableFingerprints makes BuildAll also write the static files and
+// the non-HTML outputs (such as style.css.lua) with a content hash in
+// the file name, such as style.3f9a2c1b.css, for long-lived caching.
+// Use path.asset("/style.css") in lua to get the fingerprinted link.
+func (m *Moontpl) EnableFingerprints() {
+	m.builder.fingerprint = true
+}
+
+func isFingerprintable(link string) bool {
+	base := path.Base(link)
+	ext := path.Ext(base)
+	return ext != "" && ext != ".html" && ext != ".lua" && !strings.HasPrefix(base, ".")
+}
+
+// fingerprintedLink inserts the hash before the file extension,
+// /style.css becomes /style.3f9a2c1b.css
+func fingerprintedLink(link, hash string) string {
+	ext := path.Ext(link)
+	return strings.TrimSuffix(link, ext) + "." + hash[:fingerprintLength] + ext
+}
+
+// fingerprintFile records the fingerprinted link of an asset, and
+// writes a copy of the asset with the fingerprinted name.
+// The original file must have been already written.
+func (m *Moontpl) fingerprintFile(outputDir, link, hash string) error {
+	b := m.builder
+	hashedLink := fingerprintedLink(link, hash)
+	b.assets[link] = hashedLink
+
+	if lc := b.linkChecker; lc != nil {
+		lc.addTarget(hashedLink)
+	}
+	if b.testBuild {
+		return nil
+	}
+
+	dest := filepath.Join(outputDir, link)
+	hashedDest := filepath.Join(outputDir, hashedLink)
+	m.addProducedFile(hashedDest)
+
+	// the file name already identifies the contents
+	if fsExists(hashedDest) {
+		return nil
+	}
+	return copyFile(dest, hashedDest)
+}
+
+// fingerprintJob fingerprints the output of a non-HTML lua file.
+func (m *Moontpl) fingerprintJob(outputDir string, job *buildJob) error {
+	if !isFingerprintable(string(job.link)) {
+		return nil
+	}
+
+	data := []byte(job.output)
+	if job.skipped {
+		var err error
+		if data, err = os.ReadFile(job.dest); err != nil {
+			return err
+		}
+	}
+
+	return m.fingerprintFile(outputDir, string(job.link), hashBytes(data))
+}
+
+// assetLink returns the fingerprinted link of an asset,
+// or the link itself if it isn't fingerprinted.
+// This is called while rendering pages, after all the assets are built.
+func (m *Moontpl) assetLink(link string) string {
+	if hashedLink, ok := m.builder.assets[link]; ok {
+		return hashedLink
+	}
+	return link
+}
+
+func (m *Moontpl) readAssetListing() []byte {
+	links := make([]string, 0, len(m.builder.assets))
+	for link := range m.builder.assets {
+		links = append(links, link)
+	}
+	sort.Strings(links)
+
+	var buf []byte
+	for _, link := range links {
+		buf = append(buf, link+" "+m.builder.assets[link]+"\n"...)
+	}
+	return buf
+}
@@ -0,0 +1,209 @@
+package moontpl
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+type linkRef struct {
+	url  string
+	line int
+}
+
+// pageLinks contains the ids and local link references found in a page.
+type pageLinks struct {
+	ids  map[string]struct{}
+	refs []linkRef
+}
+
+// linkChecker collects the pages and files produced by the build,
+// and then checks that all local links in the pages point to one of them.
+type linkChecker struct {
+	// targets contains the links of all the produced files, such as /dir/page.html
+	targets map[string]struct{}
+	pages   map[string]*pageLinks
+	files   map[string]string
+	order   []string
+
+	// basePath is the prefix of root-relative links, see Moontpl.BasePath
+	basePath string
+}
+
+func newLinkChecker(basePath string) *linkChecker {
+	return &linkChecker{
+		basePath: basePath,
+		targets:  map[string]struct{}{},
+		pages:    map[string]*pageLinks{},
+		files:    map[string]string{},
+	}
+}
+
+func (lc *linkChecker) addTarget(link string) {
+	lc.targets[link] = struct{}{}
+}
+
+// addPage adds a page to be checked, filename is the source
+// file of the page that will be shown in the error messages.
+func (lc *linkChecker) addPage(link, filename string, links *pageLinks) {
+	lc.addTarget(link)
+	if _, ok := lc.pages[link]; !ok {
+		lc.order = append(lc.order, link)
+	}
+	lc.pages[link] = links
+	lc.files[link] = filename
+}
+
+// addStaticFiles adds the files that CopyNonSourceFiles would copy.
+func (lc *linkChecker) addStaticFiles(siteFS fs.FS, includeStatic, includeLua bool) error {
+	return fs.WalkDir(siteFS, ".", func(p string, dir fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir.IsDir() {
+			return nil
+		}
+		if isLua := filepath.Ext(p) == ".lua"; isLua && !includeLua || !isLua && !includeStatic {
+			return nil
+		}
+		lc.addTarget("/" + p)
+		return nil
+	})
+}
+
+func (lc *linkChecker) hasTarget(link string) (string, bool) {
+	if _, ok := lc.targets[link]; ok {
+		return link, true
+	}
+	index := path.Join(link, "index.html")
+	if _, ok := lc.targets[index]; ok {
+		return index, true
+	}
+	return "", false
+}
+
+// check returns an error for each broken link, in the order the pages were added.
+// The links are found in the rendered HTML, so the line numbers are the lines
+// of the rendered page, not of its source file.
+func (lc *linkChecker) check() BuildErrors {
+	var errs BuildErrors
+	for _, pageLink := range lc.order {
+		for _, ref := range lc.pages[pageLink].refs {
+			message := lc.checkRef(pageLink, ref.url)
+			if message == "" {
+				continue
+			}
+			errs = append(errs, &BuildError{
+				Link:    pageLink,
+				Source:  lc.files[pageLink],
+				Message: fmt.Sprintf("%s (line %d of the rendered page)", message, ref.line),
+			})
+		}
+	}
+	return errs
+}
+
+func (lc *linkChecker) checkRef(pageLink, ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return fmt.Sprintf("invalid link %q: %v", ref, err)
+	}
+	if u.Scheme != "" || u.Host != "" {
+		return ""
+	}
+
+	target := pageLink
+	if u.Path != "" {
+		target = u.Path
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join(path.Dir(pageLink), target)
+		} else {
+			target = path.Clean(target)
+			if lc.basePath != "" {
+				if target != lc.basePath && !strings.HasPrefix(target, lc.basePath+"/") {
+					return fmt.Sprintf("broken link %q: not under the base path %s", ref, lc.basePath)
+				}
+				target = path.Join("/", strings.TrimPrefix(target, lc.basePath))
+			}
+		}
+		if strings.HasSuffix(u.Path, "/") && target != "/" {
+			target += "/"
+		}
+	}
+
+	target, ok := lc.hasTarget(target)
+	if !ok {
+		return fmt.Sprintf("broken link %q: target not found", ref)
+	}
+
+	if u.Fragment == "" {
+		return ""
+	}
+	if page, ok := lc.pages[target]; ok {
+		if _, ok := page.ids[u.Fragment]; !ok {
+			return fmt.Sprintf("broken link %q: no element with id %q in %s", ref, u.Fragment, target)
+		}
+	}
+
+	return ""
+}
+
+// scanHTMLLinks finds the ids and the local links (href, src and srcset)
+// in an HTML document, along with the line number where they are found.
+func scanHTMLLinks(contents []byte) *pageLinks {
+	result := &pageLinks{ids: map[string]struct{}{}}
+
+	z := html.NewTokenizer(bytes.NewReader(contents))
+	line := 1
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		tokenLine := line
+		line += bytes.Count(z.Raw(), []byte("\n"))
+
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := z.Token()
+		for _, attr := range token.Attr {
+			switch attr.Key {
+			case "id":
+				result.ids[attr.Val] = struct{}{}
+			case "name":
+				if token.Data == "a" {
+					result.ids[attr.Val] = struct{}{}
+				}
+			case "href", "src":
+				result.addRef(attr.Val, tokenLine)
+			case "srcset":
+				for _, candidate := range strings.Split(attr.Val, ",") {
+					if fields := strings.Fields(candidate); len(fields) > 0 {
+						result.addRef(fields[0], tokenLine)
+					}
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+func (pl *pageLinks) addRef(link string, line int) {
+	link = strings.TrimSpace(link)
+	if link == "" || strings.HasPrefix(link, "//") || strings.Contains(link, "://") {
+		return
+	}
+	if i := strings.Index(link, ":"); i >= 0 && !strings.ContainsAny(link[:i], "/?#") {
+		return // mailto:, javascript:, data: and so on
+	}
+	pl.refs = append(pl.refs, linkRef{url: link, line: line})
+}
@@ -0,0 +1,296 @@
+package moontpl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// The build manifest is used to skip the files that haven't changed since
+// the last build. It's stored in a cache directory next to the output
+// directory, so that it's not published along with the site.
+const manifestCacheDir = ".moontpl-cache"
+
+// manifestFilename is where the manifest was stored in the output directory
+// by the previous versions. It's removed when the new manifest is written.
+const manifestFilename = ".moontpl-manifest.json"
+
+// manifestPath returns the manifest file of outputDir, such as
+// .moontpl-cache/public.manifest.json for the output directory public.
+func manifestPath(outputDir string) string {
+	outputDir = mustAbs(outputDir)
+	return filepath.Join(
+		filepath.Dir(outputDir),
+		manifestCacheDir,
+		filepath.Base(outputDir)+".manifest.json",
+	)
+}
+
+type buildManifest struct {
+	// Settings is a hash of everything other than the source files
+	// that could change the output, such as the runtags.
+	// The whole manifest is discarded if this changes.
+	Settings string `json:"settings"`
+
+	Pages map[Link]*manifestEntry `json:"pages"`
+
+	// Files contains the hashes of the copied static files.
+	Files map[string]string `json:"files"`
+}
+
+type manifestEntry struct {
+	// Dependencies maps the page source and all the lua files
+	// it depends on to their content hash.
+	Dependencies map[string]string `json:"dependencies"`
+
+	// Queued contains the links queued with build.queue()
+	// when the page was rendered, so that they are still built
+	// even if the page is skipped.
+	Queued []Link `json:"queued,omitempty"`
+
+	// Sitemap contains the sitemap fields from page.data, if the sitemap is enabled.
+	Sitemap *sitemapURL `json:"sitemap,omitempty"`
+}
+
+func newBuildManifest(settings string) *buildManifest {
+	return &buildManifest{
+		Settings: settings,
+		Pages:    map[Link]*manifestEntry{},
+		Files:    map[string]string{},
+	}
+}
+
+// readBuildManifest returns nil if the manifest is missing, invalid,
+// or was created with different settings.
+func readBuildManifest(outputDir, settings string) *buildManifest {
+	data, err := os.ReadFile(manifestPath(outputDir))
+	if err != nil {
+		return nil
+	}
+
+	manifest := newBuildManifest("")
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil
+	}
+	if manifest.Settings != settings {
+		return nil
+	}
+
+	return manifest
+}
+
+func (bm *buildManifest) write(outputDir string) error {
+	data, err := json.MarshalIndent(bm, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filename := manifestPath(outputDir)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return err
+	}
+
+	// ignore error, the old manifest is usually not there
+	_ = os.Remove(filepath.Join(outputDir, manifestFilename))
+	return nil
+}
+
+func (m *Moontpl) buildSettings() string {
+	var tags []string
+	for t := range m.runtags {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+
+	settings := []string{
+		"version=" + Version,
+		"runtags=" + strings.Join(tags, ","),
+		"sitemap=" + strconv.FormatBool(m.builder.sitemap),
+		"prettyurls=" + strconv.FormatBool(m.PrettyURLs),
+		"basepath=" + m.basePath(),
+		"siteurl=" + m.SiteURL,
+		"fingerprint=" + strconv.FormatBool(m.builder.fingerprint),
+		"sitedata=" + siteDataSetting(m.SiteData),
+		// the order of the themes matters, the first one is used first
+		"themes=" + strings.Join(m.themeDirs, string(filepath.ListSeparator)),
+		"ignore=" + strings.Join(m.ignorePatterns, "\n"),
+		"copysource=" + strconv.FormatBool(m.builder.copyLuaSourceFiles),
+	}
+
+	return hashBytes([]byte(strings.Join(settings, "\n")))
+}
+
+// siteDataSetting encodes the site data for buildSettings.
+// The map keys are sorted by both json and fmt, so the
+// result is the same for the same data.
+func siteDataSetting(data map[string]any) string {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		// values that json can't encode, such as functions
+		return fmt.Sprint(data)
+	}
+	return string(encoded)
+}
+
+// isUpToDate checks if the job output from the previous build can be reused.
+// If so, the dependencies and queued links from the previous build are copied to the job.
+func (m *Moontpl) isUpToDate(job *buildJob) bool {
+	b := m.builder
+	if b.manifest == nil {
+		return false
+	}
+
+	entry, ok := b.manifest.Pages[job.link]
+	if !ok || !fsExists(job.dest) {
+		return false
+	}
+
+	for dep, hash := range entry.Dependencies {
+		if current, ok := m.hashDependency(dep); !ok || current != hash {
+			return false
+		}
+	}
+
+	job.deps = entry.Dependencies
+	job.queued = entry.Queued
+	job.sitemap = entry.Sitemap
+
+	return true
+}
+
+// collectDependencies returns the content hashes of
+// the page source and of all the lua modules it used.
+func (m *Moontpl) collectDependencies(L *lua.LState, src string) map[string]string {
+	result := map[string]string{}
+
+	_, filename := extractPathParams(src)
+	if hash, ok := m.hashDependency(filename); ok {
+		result[filename] = hash
+	}
+
+	dt := getDependencyTracker(L)
+	if dt == nil {
+		return result
+	}
+
+	for _, name := range dt.GetPageDependencies() {
+		dep := name
+		if !strings.HasPrefix(name, "@") {
+			var ok bool
+			if dep, ok = m.findModuleFile(L, name); !ok {
+				continue
+			}
+		}
+		if hash, ok := m.hashDependency(dep); ok {
+			result[dep] = hash
+		}
+	}
+
+	return result
+}
+
+// findModuleFile finds the lua file of the module
+// the same way require() does, using package.path.
+func (m *Moontpl) findModuleFile(L *lua.LState, moduleName string) (string, bool) {
+	lpath, ok := L.GetField(L.GetField(L.Get(lua.EnvironIndex), "package"), "path").(lua.LString)
+	if !ok {
+		return "", false
+	}
+
+	name := strings.ReplaceAll(moduleName, ".", "/")
+	for _, pattern := range strings.Split(string(lpath), ";") {
+		if pattern == "" {
+			continue
+		}
+		filename := strings.Replace(pattern, "?", name, -1)
+		if m.siteFileExists(filename) {
+			return filename, true
+		}
+		if _, err := fs.Stat(m.fsys, path.Clean(filename)); err == nil {
+			return filename, true
+		}
+	}
+
+	return "", false
+}
+
+// hashDependency returns the content hash of a file or
+// of a pseudo-module such as @pages. The hashes are cached
+// for the duration of the build, except @assets, which is
+// dropped when the assets are built (see BuildAll).
+func (m *Moontpl) hashDependency(name string) (string, bool) {
+	b := m.builder
+	b.mu.Lock()
+	hash, ok := b.hashes[name]
+	b.mu.Unlock()
+	if ok {
+		return hash, hash != ""
+	}
+
+	var data []byte
+	var err error
+	switch name {
+	case pagesDependency:
+		data, err = m.readPageSources()
+	case filesDependency:
+		data, err = m.readSiteListing()
+	case assetsDependency:
+		data = m.readAssetListing()
+	default:
+		data, err = m.readSiteFile(name)
+		if err != nil {
+			data, err = fs.ReadFile(m.fsys, path.Clean(name))
+		}
+	}
+	if err == nil {
+		hash = hashBytes(data)
+	}
+
+	b.mu.Lock()
+	b.hashes[name] = hash
+	b.mu.Unlock()
+
+	return hash, hash != ""
+}
+
+func (m *Moontpl) readPageSources() ([]byte, error) {
+	filenames, err := m.GetPageFilenames(m.SiteDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	for _, p := range filenames {
+		data, err := m.readSiteFile(p.AbsFile)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, p.Link...)
+		buf = append(buf, hashBytes(data)...)
+	}
+	return buf, nil
+}
+
+func (m *Moontpl) readSiteListing() ([]byte, error) {
+	var buf []byte
+	err := fs.WalkDir(m.siteFS(), ".", func(p string, dir fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		buf = append(buf, p...)
+		buf = append(buf, '\n')
+		return nil
+	})
+	return buf, err
+}
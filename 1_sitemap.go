@@ -0,0 +1,141 @@
+package moontpl
+
+import (
+	"encoding/xml"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	sitemapFilename = "sitemap.xml"
+	robotsFilename  = "robots.txt"
+	sitemapXmlns    = "http://www.sitemaps.org/schemas/sitemap/0.9"
+)
+
+type sitemapURLSet struct {
+	XMLName xml.Name      `xml:"urlset"`
+	Xmlns   string        `xml:"xmlns,attr"`
+	URLs    []*sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc        string `xml:"loc" json:"-"`
+	LastMod    string `xml:"lastmod,omitempty" json:"lastmod,omitempty"`
+	ChangeFreq string `xml:"changefreq,omitempty" json:"changefreq,omitempty"`
+	Priority   string `xml:"priority,omitempty" json:"priority,omitempty"`
+
+	// Exclude is set when the page has page.data.sitemap = false
+	Exclude bool `xml:"-" json:"exclude,omitempty"`
+}
+
+// EnableSitemap makes BuildAll generate a sitemap.xml in the output directory,
+// and optionally a robots.txt that points to it.
+// SiteURL must be set, since the sitemap URLs must be absolute.
+func (m *Moontpl) EnableSitemap(robots bool) {
+	m.builder.sitemap = true
+	m.builder.robots = robots
+}
+
+// getSitemapData reads the sitemap fields from page.data
+// of the page that was just rendered.
+func (m *Moontpl) getSitemapData(L *lua.LState, src string) *sitemapURL {
+	result := &sitemapURL{}
+
+	var data *lua.LTable
+	if page, ok := getLoadedModule(L, "page").(*lua.LTable); ok {
+		data, _ = page.RawGetString("data").(*lua.LTable)
+	}
+	if data != nil {
+		if data.RawGetString("sitemap") == lua.LFalse {
+			result.Exclude = true
+			return result
+		}
+
+		get := func(key string) string {
+			if lv := data.RawGetString(key); lv != lua.LNil {
+				return lv.String()
+			}
+			return ""
+		}
+		result.LastMod = get("lastmod")
+		result.ChangeFreq = get("changefreq")
+		result.Priority = get("priority")
+	}
+
+	if result.LastMod == "" {
+		_, filename := extractPathParams(src)
+		// the files in an embed.FS have no modification time
+		if stat, err := m.statSiteFile(filename); err == nil && stat != nil && !stat.ModTime().IsZero() {
+			result.LastMod = stat.ModTime().UTC().Format("2006-01-02")
+		}
+	}
+
+	return result
+}
+
+func (m *Moontpl) absoluteURL(link string) string {
+	u := url.URL{Path: link}
+	return m.siteBaseURL(m.SiteURL) + u.EscapedPath()
+}
+
+// writeSitemap writes the sitemap.xml and robots.txt into the outputDir,
+// unless the site already has its own.
+func (m *Moontpl) writeSitemap(outputDir string, entries map[Link]*sitemapURL) error {
+	b := m.builder
+
+	if _, exists := b.produced[filepath.Join(mustAbs(outputDir), sitemapFilename)]; !exists {
+		var links []string
+		for link, entry := range entries {
+			if !entry.Exclude {
+				links = append(links, string(link))
+			}
+		}
+		sort.Strings(links)
+
+		urlset := sitemapURLSet{Xmlns: sitemapXmlns}
+		for _, link := range links {
+			entry := *entries[Link(link)]
+			entry.Loc = m.absoluteURL(m.outputLink(link))
+			urlset.URLs = append(urlset.URLs, &entry)
+		}
+
+		data, err := xml.MarshalIndent(urlset, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append([]byte(xml.Header), data...)
+		data = append(data, '\n')
+
+		if err := m.writeGeneratedFile(outputDir, sitemapFilename, data); err != nil {
+			return err
+		}
+	}
+
+	if _, exists := b.produced[filepath.Join(mustAbs(outputDir), robotsFilename)]; b.robots && !exists {
+		robots := "User-agent: *\nAllow: /\n\nSitemap: " + m.absoluteURL("/"+sitemapFilename) + "\n"
+		if err := m.writeGeneratedFile(outputDir, robotsFilename, []byte(robots)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeGeneratedFile writes a file that was generated by moontpl itself,
+// instead of being rendered from a lua file.
+func (m *Moontpl) writeGeneratedFile(outputDir, name string, data []byte) error {
+	dest := filepath.Join(outputDir, name)
+	log.Print("generate ", mustRel(mustGetwd(), dest))
+
+	m.addProducedFile(dest)
+	if lc := m.builder.linkChecker; lc != nil {
+		lc.addTarget("/" + name)
+	}
+
+	return os.WriteFile(dest, data, 0644)
+}
@@ -0,0 +1,226 @@
+package moontpl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// isDataOutput returns true if a table returned by a page
+// with the extension is serialized instead of converted to string.
+func isDataOutput(ext string) bool {
+	switch ext {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// encodeDataOutput serializes the table returned by a .json.lua or .yaml.lua page.
+// The output is pretty-printed, unless the minify runtag is set.
+// page.data.pretty overrides this for a single page.
+func (m *Moontpl) encodeDataOutput(L *lua.LState, ext string, tbl *lua.LTable) (string, error) {
+	pretty := !m.hasRunTag(minifyRunTag)
+	if page, ok := getLoadedModule(L, "page").(*lua.LTable); ok {
+		if data, ok := page.RawGetString("data").(*lua.LTable); ok {
+			if p, ok := data.RawGetString("pretty").(lua.LBool); ok {
+				pretty = bool(p)
+			}
+		}
+	}
+
+	value, err := luaToDataValue(tbl, map[*lua.LTable]bool{})
+	if err != nil {
+		return "", err
+	}
+
+	if ext == ".json" || !pretty {
+		return encodeJSON(value, pretty)
+	}
+	return encodeYAML(value), nil
+}
+
+// luaToDataValue converts a lua value to a value that can be serialized:
+// nil, bool, float64, string, []any or map[string]any.
+// A table is an array if its keys are 1..n, an empty table is an empty object.
+func luaToDataValue(lv lua.LValue, visited map[*lua.LTable]bool) (any, error) {
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return nil, fmt.Errorf("cannot serialize number %v", v)
+		}
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if visited[v] {
+			return nil, fmt.Errorf("cannot serialize a table that contains itself")
+		}
+		visited[v] = true
+		defer delete(visited, v)
+
+		if n := v.Len(); n > 0 && countTableKeys(v) == n {
+			result := make([]any, n)
+			for i := 1; i <= n; i++ {
+				item, err := luaToDataValue(v.RawGetInt(i), visited)
+				if err != nil {
+					return nil, err
+				}
+				result[i-1] = item
+			}
+			return result, nil
+		}
+
+		result := map[string]any{}
+		var err error
+		v.ForEach(func(key, val lua.LValue) {
+			if err != nil {
+				return
+			}
+			var k string
+			switch key := key.(type) {
+			case lua.LString:
+				k = string(key)
+			case lua.LNumber:
+				k = key.String()
+			default:
+				err = fmt.Errorf("cannot serialize a table key of type %s", key.Type())
+				return
+			}
+			result[k], err = luaToDataValue(val, visited)
+		})
+		return result, err
+	}
+
+	return nil, fmt.Errorf("cannot serialize a value of type %s", lv.Type())
+}
+
+func countTableKeys(t *lua.LTable) int {
+	n := 0
+	t.ForEach(func(_, _ lua.LValue) { n++ })
+	return n
+}
+
+// encodeJSON encodes the value with sorted object keys.
+func encodeJSON(value any, pretty bool) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(value); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// encodeYAML encodes the value in block style, with sorted keys.
+func encodeYAML(value any) string {
+	var buf strings.Builder
+	writeYAML(&buf, value, 0)
+	return buf.String()
+}
+
+func writeYAML(buf *strings.Builder, value any, indent int) {
+	prefix := strings.Repeat("  ", indent)
+
+	switch v := value.(type) {
+	case map[string]any:
+		if len(v) == 0 {
+			buf.WriteString(prefix + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			buf.WriteString(prefix + yamlString(k) + ":")
+			writeYAMLItem(buf, v[k], indent+1)
+		}
+
+	case []any:
+		for _, item := range v {
+			// the first key of an object is written on the same line as the "-"
+			if obj, ok := item.(map[string]any); ok && len(obj) > 0 {
+				var sub strings.Builder
+				writeYAML(&sub, obj, indent+1)
+				buf.WriteString(prefix + "- " + strings.TrimPrefix(sub.String(), prefix+"  "))
+				continue
+			}
+			buf.WriteString(prefix + "-")
+			writeYAMLItem(buf, item, indent+1)
+		}
+
+	default:
+		buf.WriteString(prefix + yamlScalar(v) + "\n")
+	}
+}
+
+// writeYAMLItem writes the value of a key or list item,
+// after the "key:" or "-" that was already written.
+func writeYAMLItem(buf *strings.Builder, value any, indent int) {
+	switch v := value.(type) {
+	case map[string]any:
+		if len(v) == 0 {
+			buf.WriteString(" {}\n")
+			return
+		}
+	case []any:
+		if len(v) == 0 {
+			buf.WriteString(" []\n")
+			return
+		}
+	default:
+		buf.WriteString(" " + yamlScalar(v) + "\n")
+		return
+	}
+	buf.WriteString("\n")
+	writeYAML(buf, value, indent)
+}
+
+func yamlScalar(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return yamlString(v)
+	}
+	return ""
+}
+
+var (
+	yamlPlainRe    = regexp.MustCompile(`^[A-Za-z_/.][A-Za-z0-9_ ./@+-]*$`)
+	yamlReservedRe = regexp.MustCompile(`(?i)^(true|false|yes|no|on|off|y|n|null|~|\.inf|\.nan)$`)
+)
+
+// yamlString quotes the string unless it can't be mistaken for another type.
+func yamlString(s string) string {
+	if yamlPlainRe.MatchString(s) && !yamlReservedRe.MatchString(s) && !strings.HasSuffix(s, " ") {
+		return s
+	}
+	// a JSON string is also a valid YAML string
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -0,0 +1,420 @@
+package moontpl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	lua "github.com/yuin/gopher-lua"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// writeFormattedHTML writes the lua value as formatted html. The html nodes
+// are serialized and formatted at the same time, so that the page is never
+// held in memory as a whole, see formatHTML.
+func writeFormattedHTML(L *lua.LState, w io.Writer, lv lua.LValue) error {
+	pr, pw := io.Pipe()
+
+	type result struct {
+		err   error
+		panic any
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		defer func() {
+			// lua errors in the __tostring metamethods are raised
+			// as panics, these are passed on to the caller, where
+			// they are recovered by protectedCall
+			res.panic = recover()
+			if res.panic != nil {
+				pw.CloseWithError(errors.New("html serialization failed"))
+			}
+			done <- res
+		}()
+		res.err = writeLuaValue(L, pw, lv)
+		pw.CloseWithError(res.err)
+	}()
+
+	err := formatHTML(w, pr)
+	// stops the serialization if the formatting failed
+	pr.CloseWithError(io.ErrClosedPipe)
+
+	res := <-done
+	if res.panic != nil {
+		panic(res.panic)
+	}
+	if res.err != nil && !errors.Is(res.err, io.ErrClosedPipe) {
+		return res.err
+	}
+	return err
+}
+
+// formatHTML writes the html read from r with each block element
+// on its own line and indented. This is the same as htmlformat.Format,
+// but it reads the html as a stream, in a single pass.
+func formatHTML(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	z := html.NewTokenizer(r)
+	depth := 0
+	pool := &formatNodePool{}
+	preDepth := 0
+
+	root := new(html.Node)
+	parent := root
+	token := new(html.Token)
+
+	createNode := func(token *html.Token, ntype html.NodeType, parent *html.Node) *html.Node {
+		node := pool.get()
+		node.Type = ntype
+		node.DataAtom = token.DataAtom
+		node.Attr = token.Attr
+		node.Data = token.Data
+		if parent != nil {
+			parent.AppendChild(node)
+		}
+		return node
+	}
+
+	initToken := func(tt html.TokenType, t *html.Token) *html.Token {
+		t.Type = tt
+		t.Attr = t.Attr[:0]
+		switch tt {
+		case html.CommentToken, html.DoctypeToken:
+			t.Data = string(z.Text())
+		case html.TextToken:
+			// Raw() keeps the escaped characters escaped
+			t.Data = string(z.Raw())
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			name, moreAttr := z.TagName()
+			for moreAttr {
+				var key, val []byte
+				key, val, moreAttr = z.TagAttr()
+				t.Attr = append(t.Attr, html.Attribute{
+					Key: atom.String(key),
+					Val: string(val),
+				})
+			}
+			if a := atom.Lookup(name); a != 0 {
+				t.DataAtom, t.Data = a, a.String()
+			} else {
+				t.DataAtom, t.Data = 0, string(name)
+			}
+		}
+		return t
+	}
+
+loop:
+	for {
+		tt := z.Next()
+		indent := strings.Repeat(" ", depth*4)
+
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				break loop
+			}
+			return z.Err()
+
+		case html.TextToken:
+			node := createNode(initToken(tt, token), html.TextNode, parent)
+			shouldDedent := false
+
+			if node.Parent != nil {
+				switch node.Parent.Data {
+				case "script", "style":
+					shouldDedent = true
+				}
+			}
+
+			if preDepth > 0 {
+				bw.WriteString(node.Data)
+			} else if shouldDedent {
+				node.Data = formatCollapseWhitespace("\n" + formatDedent(node.Data) + "\n")
+				for line := range getLines(node.Data) {
+					if strings.ContainsFunc(line, isNotSpace) {
+						bw.WriteString(indent)
+					}
+					bw.WriteString(line)
+				}
+			} else {
+				node.Data = formatCollapseWhitespace(node.Data)
+				lineno := 0
+				for line := range getLines(node.Data) {
+					if len(line) == 0 {
+						continue
+					}
+					if lineno > 0 {
+						if strings.ContainsFunc(line, isNotSpace) {
+							bw.WriteString(indent)
+						}
+						bw.WriteString(strings.TrimLeft(line, "\t "))
+					} else {
+						bw.WriteString(line)
+					}
+					lineno++
+				}
+			}
+
+		case html.SelfClosingTagToken, html.StartTagToken:
+			node := createNode(initToken(tt, token), html.ElementNode, parent)
+
+			if tt != html.SelfClosingTagToken && !isFormatVoid(node) {
+				parent = node
+				depth++
+			}
+
+			if node.DataAtom == atom.Pre {
+				preDepth++
+			}
+
+			if preDepth <= 0 {
+				if node.Parent != nil && !endsWithNewLine(node.PrevSibling) && !isFormatInline(node.Parent) {
+					if node.Parent.FirstChild == node || !isFormatInline(node) || (isFormatInline(node) && !isFormatInline(node.PrevSibling)) {
+						ws := pool.get()
+						ws.Type = html.TextNode
+						ws.Data = "\n"
+						node.Parent.InsertBefore(ws, node)
+						bw.WriteString("\n")
+					}
+				}
+
+				if endsWithNewLine(node.PrevSibling) || endsWithNewLine(node.Parent) {
+					bw.WriteString(indent)
+				}
+			}
+			bw.WriteString("<" + node.Data)
+
+			for _, attr := range node.Attr {
+				if attr.Val == "" {
+					bw.WriteString(" " + attr.Key)
+				} else {
+					fmt.Fprintf(bw, ` %s=%q`, attr.Key, attr.Val)
+				}
+			}
+			bw.WriteString(">")
+
+		case html.EndTagToken:
+			if parent == root {
+				// an end tag without a start tag
+				bw.Write(z.Raw())
+				continue
+			}
+			node := parent
+			parent = node.Parent
+			if depth > 0 {
+				depth--
+			}
+			indent := strings.Repeat(" ", depth*4)
+
+			if !isFormatVoid(node) {
+				if preDepth <= 0 {
+					if endsWithNewLine(node.LastChild) {
+						bw.WriteString(indent)
+					} else if startsWithNewLine(node.FirstChild) {
+						bw.WriteString("\n" + indent)
+					}
+				}
+				bw.WriteString("</" + node.Data + ">")
+			}
+
+			if node.DataAtom == atom.Pre && preDepth > 0 {
+				preDepth--
+			}
+
+			for c := node.FirstChild; c != nil; c = c.NextSibling {
+				node.RemoveChild(c)
+				pool.free(c)
+			}
+
+		case html.DoctypeToken:
+			bw.Write(z.Raw())
+
+		case html.CommentToken:
+			node := createNode(initToken(tt, token), html.TextNode, parent)
+			node.Data = formatCollapseWhitespace(formatDedent(node.Data))
+
+			if parent != nil {
+				lastChild := parent.LastChild
+				if (lastChild != nil && endsWithNewLine(lastChild.PrevSibling)) || endsWithNewLine(parent) {
+					bw.WriteString(indent)
+				}
+			}
+			bw.WriteString("<!--")
+
+			lineNum := 0
+			for line := range getLines(node.Data) {
+				if lineNum > 1 {
+					bw.WriteString(indent)
+				} else if strings.HasPrefix(node.Data, "\n") {
+					bw.WriteString(indent)
+				}
+				bw.WriteString(line)
+				lineNum++
+			}
+
+			if strings.HasSuffix(node.Data, "\n") {
+				bw.WriteString(indent)
+			}
+			bw.WriteString("-->")
+		}
+	}
+
+	return bw.Flush()
+}
+
+var formatInlineElements = map[atom.Atom]bool{
+	atom.A: true, atom.Abbr: true, atom.Acronym: true, atom.Button: true,
+	atom.Br: true, atom.Big: true, atom.Bdo: true, atom.B: true,
+	atom.Cite: true, atom.Code: true, atom.Dfn: true, atom.I: true,
+	atom.Em: true, atom.Img: true, atom.Input: true, atom.Kbd: true,
+	atom.Label: true, atom.Map: true, atom.Object: true, atom.Output: true,
+	atom.Tt: true, atom.Time: true, atom.Samp: true, atom.Script: true,
+	atom.Style: true, atom.Select: true, atom.Small: true, atom.Span: true,
+	atom.Strong: true, atom.Sub: true, atom.Sup: true, atom.Strike: true,
+	atom.Textarea: true,
+}
+
+var formatVoidElements = map[atom.Atom]bool{
+	atom.Area: true, atom.Base: true, atom.Br: true, atom.Col: true,
+	atom.Command: true, atom.Embed: true, atom.Hr: true, atom.Img: true,
+	atom.Input: true, atom.Keygen: true, atom.Link: true, atom.Meta: true,
+	atom.Param: true, atom.Source: true, atom.Track: true, atom.Wbr: true,
+}
+
+func isFormatInline(node *html.Node) bool {
+	if node == nil {
+		return false
+	}
+	return node.Type == html.TextNode || formatInlineElements[node.DataAtom]
+}
+
+func isFormatVoid(node *html.Node) bool {
+	return node != nil && formatVoidElements[node.DataAtom]
+}
+
+// formatNodePool reuses the nodes of the closed elements,
+// the formatter only keeps the open elements and their children.
+type formatNodePool struct {
+	data []*html.Node
+}
+
+func (np *formatNodePool) get() *html.Node {
+	if len(np.data) > 0 {
+		node := np.data[0]
+		np.data = np.data[1:]
+		return node
+	}
+	return &html.Node{}
+}
+
+func (np *formatNodePool) free(node *html.Node) {
+	if node.Parent != nil {
+		node.Parent.RemoveChild(node)
+	}
+	np.data = append(np.data, node)
+}
+
+func formatDedent(s string) string {
+	var buf bytes.Buffer
+	indentSize := -1
+
+	if strings.Count(s, "\n") <= 1 {
+		return s
+	}
+
+	for line := range getLines(s) {
+		numSpaces := 0
+		index := 0
+		found := false
+		for i, c := range line {
+			index = i
+			if !unicode.IsSpace(c) {
+				found = true
+				break
+			}
+			if c == '\t' {
+				numSpaces += 4
+			} else {
+				numSpaces += 1
+			}
+		}
+
+		if indentSize < 0 {
+			if found {
+				indentSize = numSpaces
+				buf.WriteString(line[index:])
+			} else {
+				buf.WriteString(line)
+			}
+			continue
+		}
+
+		buf.WriteString(strings.Repeat(" ", max(numSpaces-indentSize, 0)))
+		buf.WriteString(line[index:])
+	}
+
+	return buf.String()
+}
+
+// formatCollapseWhitespace replaces the leading and the trailing
+// whitespace with a single newline, if there's one, or a space.
+func formatCollapseWhitespace(s string) string {
+	start := 0
+	for start < len(s) && unicode.IsSpace(rune(s[start])) {
+		start++
+	}
+	if start > 0 {
+		space := " "
+		if strings.Contains(s[:start], "\n") {
+			space = "\n"
+		}
+		s = space + s[start:]
+	}
+
+	end := len(s)
+	for end > 0 && unicode.IsSpace(rune(s[end-1])) {
+		end--
+	}
+	if end < len(s) {
+		space := " "
+		if strings.Contains(s[end:], "\n") {
+			space = "\n"
+		}
+		s = s[:end] + space
+	}
+	return s
+}
+
+func isNotSpace(r rune) bool { return !unicode.IsSpace(r) }
+
+func startsWithNewLine(node *html.Node) bool {
+	if node == nil {
+		return false
+	}
+	if node.Type == html.TextNode {
+		return strings.HasPrefix(node.Data, "\n")
+	}
+	if node.Type == html.ElementNode {
+		return startsWithNewLine(node.LastChild)
+	}
+	return true
+}
+
+func endsWithNewLine(node *html.Node) bool {
+	if node == nil {
+		return false
+	}
+	if node.Type == html.TextNode {
+		return strings.HasSuffix(node.Data, "\n")
+	}
+	if node.Type == html.ElementNode {
+		return endsWithNewLine(node.LastChild)
+	}
+	return true
+}
@@ -0,0 +1,496 @@
+package moontpl
+
+import (
+	"strings"
+)
+
+// minifyRunTag enables the minified output of the html, css and js files.
+// It's set with `moontpl build --minify`, or with AddRunTags("minify").
+const minifyRunTag = "minify"
+
+func (m *Moontpl) hasRunTag(tag string) bool {
+	_, ok := m.runtags[tag]
+	return ok
+}
+
+// Elements where the whitespace around them is not significant.
+var htmlBlockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "base": true, "blockquote": true,
+	"body": true, "br": true, "caption": true, "col": true, "colgroup": true,
+	"dd": true, "details": true, "dialog": true, "div": true, "dl": true, "dt": true,
+	"fieldset": true, "figcaption": true, "figure": true, "footer": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"head": true, "header": true, "hgroup": true, "hr": true, "html": true,
+	"li": true, "link": true, "main": true, "meta": true, "nav": true, "ol": true,
+	"option": true, "p": true, "pre": true, "script": true, "section": true,
+	"style": true, "summary": true, "table": true, "tbody": true, "td": true,
+	"tfoot": true, "th": true, "thead": true, "title": true, "tr": true, "ul": true,
+	"!doctype": true,
+}
+
+// Elements that can't have contents, so their self-closing slash is not needed.
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+// Elements whose contents are copied without changing the whitespace.
+// The contents of script and style are compacted separately.
+var htmlPreformattedElements = map[string]bool{
+	"pre": true, "textarea": true, "script": true, "style": true,
+}
+
+type htmlToken struct {
+	text  string
+	tag   string // lowercase tag name, or empty for text
+	start bool
+}
+
+// minifyHTML collapses the whitespace in the text, removes the comments
+// and the unneeded attribute quotes, and compacts the
+// contents of the <script> and <style> elements.
+// The contents of <pre> and <textarea> are kept as is.
+func minifyHTML(input string) string {
+	tokens := tokenizeHTML(input)
+
+	var buf strings.Builder
+	buf.Grow(len(input))
+
+	for i, tok := range tokens {
+		if tok.tag != "" {
+			buf.WriteString(tok.text)
+			continue
+		}
+
+		text := tok.text
+		if i > 0 && tokens[i-1].start && htmlPreformattedElements[tokens[i-1].tag] {
+			switch tokens[i-1].tag {
+			case "script":
+				if isJavascriptTag(tokens[i-1].text) {
+					text = minifyJS(text)
+				}
+			case "style":
+				text = minifyCSS(text)
+			}
+			buf.WriteString(text)
+			continue
+		}
+
+		text = collapseWhitespace(text)
+		if i == 0 || htmlBlockElements[tokens[i-1].tag] {
+			text = strings.TrimLeft(text, " ")
+		}
+		if i == len(tokens)-1 || htmlBlockElements[tokens[i+1].tag] {
+			text = strings.TrimRight(text, " ")
+		}
+		buf.WriteString(text)
+	}
+
+	return buf.String()
+}
+
+func tokenizeHTML(input string) []htmlToken {
+	var tokens []htmlToken
+	textStart := 0
+
+	addText := func(end int) {
+		if end <= textStart {
+			return
+		}
+		// join the text around the removed comments
+		if n := len(tokens); n > 0 && tokens[n-1].tag == "" {
+			tokens[n-1].text += input[textStart:end]
+		} else {
+			tokens = append(tokens, htmlToken{text: input[textStart:end]})
+		}
+	}
+
+	for i := 0; i < len(input); {
+		if input[i] != '<' || i+1 >= len(input) {
+			i++
+			continue
+		}
+
+		switch c := input[i+1]; {
+		case strings.HasPrefix(input[i:], "<!--"):
+			addText(i)
+			end := strings.Index(input[i+4:], "-->")
+			if end < 0 {
+				i = len(input)
+			} else {
+				i += 4 + end + 3
+			}
+			textStart = i
+
+		case c == '!' || c == '/' || isASCIILetter(c):
+			end := findTagEnd(input, i)
+			addText(i)
+
+			tok := parseHTMLTag(input[i:end])
+			tokens = append(tokens, tok)
+			i = end
+			textStart = i
+
+			if tok.start && htmlPreformattedElements[tok.tag] {
+				closing := indexFold(input[i:], "</"+tok.tag)
+				if closing < 0 {
+					closing = len(input) - i
+				}
+				tokens = append(tokens, htmlToken{text: input[i : i+closing]})
+				i += closing
+				textStart = i
+			}
+
+		default:
+			i++
+		}
+	}
+	addText(len(input))
+
+	return tokens
+}
+
+// findTagEnd returns the index after the '>' of the tag that starts at i,
+// skipping the quoted attribute values.
+func findTagEnd(input string, i int) int {
+	var quote byte
+	for ; i < len(input); i++ {
+		switch c := input[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return len(input)
+}
+
+// parseHTMLTag rewrites a tag, such as <a href="/x" class='y'>,
+// with the minimum whitespace and quotes.
+func parseHTMLTag(tag string) htmlToken {
+	if strings.HasPrefix(tag, "</") {
+		name := strings.TrimSpace(strings.Trim(tag, "</>"))
+		return htmlToken{text: "</" + name + ">", tag: strings.ToLower(name)}
+	}
+	if strings.HasPrefix(tag, "<!") {
+		name := strings.ToLower(strings.Fields(tag[1:] + " ")[0])
+		return htmlToken{text: collapseWhitespace(tag), tag: strings.TrimSuffix(name, ">")}
+	}
+
+	body := strings.TrimSuffix(tag[1:], ">")
+	selfClosing := strings.HasSuffix(body, "/")
+	body = strings.TrimSuffix(body, "/")
+
+	nameEnd := strings.IndexAny(body, " \t\n\r\f")
+	if nameEnd < 0 {
+		nameEnd = len(body)
+	}
+	name := body[:nameEnd]
+
+	var buf strings.Builder
+	buf.WriteString("<" + name)
+
+	// an unquoted value can't be followed by the / of a self-closing tag
+	lastUnquoted := false
+
+	rest := body[nameEnd:]
+	for {
+		rest = strings.TrimLeft(rest, " \t\n\r\f")
+		if rest == "" {
+			break
+		}
+
+		keyEnd := strings.IndexAny(rest, " \t\n\r\f=")
+		if keyEnd < 0 {
+			keyEnd = len(rest)
+		}
+		key := rest[:keyEnd]
+		rest = strings.TrimLeft(rest[keyEnd:], " \t\n\r\f")
+
+		buf.WriteString(" " + key)
+		lastUnquoted = false
+		if !strings.HasPrefix(rest, "=") {
+			continue
+		}
+		rest = strings.TrimLeft(rest[1:], " \t\n\r\f")
+
+		var value string
+		quoted := false
+		if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+			end := strings.IndexByte(rest[1:], rest[0])
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			value = rest[1 : end+1]
+			rest = rest[min(end+2, len(rest)):]
+			quoted = true
+		} else {
+			end := strings.IndexAny(rest, " \t\n\r\f")
+			if end < 0 {
+				end = len(rest)
+			}
+			value = rest[:end]
+			rest = rest[end:]
+		}
+
+		switch {
+		case value == "":
+			// <input disabled=""> is the same as <input disabled>
+		case quoted && (strings.ContainsAny(value, " \t\n\r\f\"'=<>`") || strings.HasSuffix(value, "/")):
+			if strings.IndexByte(value, '"') >= 0 {
+				buf.WriteString("='" + value + "'")
+			} else {
+				buf.WriteString(`="` + value + `"`)
+			}
+		default:
+			buf.WriteString("=" + value)
+			lastUnquoted = true
+		}
+	}
+
+	if selfClosing && !htmlVoidElements[strings.ToLower(name)] {
+		if lastUnquoted {
+			buf.WriteString(" ")
+		}
+		buf.WriteString("/")
+	}
+	buf.WriteString(">")
+
+	return htmlToken{text: buf.String(), tag: strings.ToLower(name), start: true}
+}
+
+func isJavascriptTag(tag string) bool {
+	i := indexFold(tag, "type=")
+	if i < 0 {
+		return true
+	}
+	t := strings.ToLower(strings.Trim(strings.Fields(tag[i+5:] + " ")[0], `"'>/`))
+	return t == "" || t == "module" || strings.HasSuffix(t, "javascript") || strings.HasSuffix(t, "ecmascript")
+}
+
+func collapseWhitespace(s string) string {
+	var buf strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ' ', '\t', '\n', '\r', '\f':
+			if !space {
+				buf.WriteByte(' ')
+				space = true
+			}
+		default:
+			buf.WriteByte(c)
+			space = false
+		}
+	}
+	return buf.String()
+}
+
+// minifyCSS removes the comments and the unneeded whitespace and semicolons.
+func minifyCSS(input string) string {
+	var buf strings.Builder
+	buf.Grow(len(input))
+
+	// characters where the whitespace around them can be removed
+	const punct = "{};,>"
+
+	space := false
+	// semicolon is a ';' that's not written yet,
+	// since it's not needed before a '}'
+	semicolon := false
+	writeSpace := func(next byte) {
+		if semicolon {
+			buf.WriteByte(';')
+			semicolon = false
+		}
+		if space && buf.Len() > 0 && !strings.ContainsRune(punct, rune(next)) {
+			last := buf.String()[buf.Len()-1]
+			if !strings.ContainsRune(punct+":", rune(last)) {
+				buf.WriteByte(' ')
+			}
+		}
+		space = false
+	}
+
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case c == '/' && i+1 < len(input) && input[i+1] == '*':
+			end := strings.Index(input[i+2:], "*/")
+			if end < 0 {
+				i = len(input)
+			} else {
+				i += 2 + end + 1
+			}
+			space = true
+
+		case c == '"' || c == '\'':
+			writeSpace(c)
+			end := i + 1
+			for end < len(input) && input[end] != c {
+				if input[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end, len(input)-1)
+			buf.WriteString(input[i : end+1])
+			i = end
+
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			space = true
+
+		case c == '}':
+			space, semicolon = false, false
+			buf.WriteByte(c)
+
+		case c == ';':
+			writeSpace(c)
+			semicolon = true
+
+		default:
+			writeSpace(c)
+			buf.WriteByte(c)
+		}
+	}
+
+	if semicolon {
+		buf.WriteByte(';')
+	}
+	return buf.String()
+}
+
+// minifyJS removes the comments and the indentation.
+// The line breaks are kept, since removing them
+// can change the meaning of the code without semicolons.
+func minifyJS(input string) string {
+	var buf strings.Builder
+	buf.Grow(len(input))
+
+	// lastSignificant is the last non-whitespace character,
+	// used to tell a regex literal from a division.
+	var lastSignificant byte
+	space := false
+	newline := false
+
+	// the whitespace around these is not needed
+	const punct = "{}()[];,:"
+
+	write := func(s string) {
+		if buf.Len() > 0 && (newline || space) {
+			switch {
+			case newline && !strings.ContainsRune("{(,;[", rune(lastSignificant)) && !strings.ContainsRune("}),;]", rune(s[0])):
+				buf.WriteByte('\n')
+			case !strings.ContainsRune(punct, rune(lastSignificant)) && !strings.ContainsRune(punct, rune(s[0])):
+				buf.WriteByte(' ')
+			}
+		}
+		newline, space = false, false
+		buf.WriteString(s)
+		lastSignificant = s[len(s)-1]
+	}
+
+	// skipQuoted returns the index of the closing quote
+	skipQuoted := func(i int, quote byte) int {
+		for i++; i < len(input) && input[i] != quote; i++ {
+			if input[i] == '\\' {
+				i++
+			} else if quote != '`' && input[i] == '\n' {
+				break
+			}
+		}
+		return min(i, len(input)-1)
+	}
+
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case c == '/' && i+1 < len(input) && input[i+1] == '/':
+			end := strings.IndexByte(input[i:], '\n')
+			if end < 0 {
+				i = len(input)
+			} else {
+				i += end - 1
+			}
+
+		case c == '/' && i+1 < len(input) && input[i+1] == '*':
+			end := strings.Index(input[i+2:], "*/")
+			if end < 0 {
+				i = len(input)
+			} else {
+				i += 2 + end + 1
+			}
+			space = true
+
+		case c == '"' || c == '\'' || c == '`':
+			end := skipQuoted(i, c)
+			write(input[i : end+1])
+			i = end
+
+		case c == '/' && isRegexStart(lastSignificant, buf.String()):
+			end := i + 1
+			inClass := false
+			for ; end < len(input) && input[end] != '\n'; end++ {
+				if input[end] == '\\' {
+					end++
+				} else if input[end] == '[' {
+					inClass = true
+				} else if input[end] == ']' {
+					inClass = false
+				} else if input[end] == '/' && !inClass {
+					break
+				}
+			}
+			end = min(end, len(input)-1)
+			write(input[i : end+1])
+			i = end
+
+		case c == '\n' || c == '\r':
+			newline = true
+
+		case c == ' ' || c == '\t' || c == '\f':
+			space = true
+
+		default:
+			// not string(c), which would turn each byte
+			// of a non-ascii character into a rune
+			write(input[i : i+1])
+		}
+	}
+
+	return buf.String()
+}
+
+// isRegexStart returns true if a '/' after the code so far
+// starts a regex literal instead of a division.
+func isRegexStart(last byte, code string) bool {
+	if last == 0 || strings.IndexByte("(,=:[!&|?{};+-*%<>~^", last) >= 0 {
+		return true
+	}
+	for _, keyword := range []string{"return", "typeof", "case", "do", "else", "in", "of", "void", "yield", "await"} {
+		if strings.HasSuffix(code, keyword) {
+			before := strings.TrimSuffix(code, keyword)
+			if before == "" || !isIdentChar(before[len(before)-1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isIdentChar(c byte) bool {
+	return isASCIILetter(c) || (c >= '0' && c <= '9') || c == '_' || c == '$'
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// indexFold is a case-insensitive strings.Index
+func indexFold(s, substr string) int {
+	return strings.Index(strings.ToLower(s), strings.ToLower(substr))
+}
@@ -0,0 +1,205 @@
+package moontpl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// isHTMLNode returns true if lv is a node created by the html module,
+// such as DIV {...}. The nodes are identified by their metatable.
+func isHTMLNode(L *lua.LState, lv lua.LValue) bool {
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		return false
+	}
+	_, hasTag := tbl.RawGetString("tag").(lua.LString)
+	return hasTag && L.GetMetaField(tbl, "__textContent") != lua.LNil
+}
+
+// writeHTMLNode serializes the node the same way as tostring(node)
+// in lua, but writes the output straight to w, instead of
+// concatenating the whole page into a single string.
+func writeHTMLNode(L *lua.LState, w io.Writer, node lua.LValue) error {
+	bw, ok := w.(*bufio.Writer)
+	if !ok {
+		bw = bufio.NewWriter(w)
+	}
+
+	nw := &nodeWriter{L: L, w: bw}
+	nw.writeNode(node)
+	if nw.err != nil {
+		return nw.err
+	}
+	return bw.Flush()
+}
+
+type nodeWriter struct {
+	L   *lua.LState
+	w   *bufio.Writer
+	err error
+}
+
+var (
+	htmlEscaper = strings.NewReplacer("&", "&amp;", ">", "&gt;", "<", "&lt;")
+	attrEscaper = strings.NewReplacer(`"`, "&quot;", "'", "&#39;")
+)
+
+func (nw *nodeWriter) writeString(s string) {
+	if nw.err == nil {
+		_, nw.err = nw.w.WriteString(s)
+	}
+}
+
+// See nodeToString in lua/html.lua
+func (nw *nodeWriter) writeNode(lv lua.LValue) {
+	node, ok := lv.(*lua.LTable)
+	if !ok || nw.err != nil {
+		return
+	}
+	tag, ok := node.RawGetString("tag").(lua.LString)
+	if !ok {
+		return
+	}
+
+	options, _ := node.RawGetString("options").(*lua.LTable)
+	option := func(name string) lua.LValue {
+		if options == nil {
+			return lua.LNil
+		}
+		return options.RawGetString(name)
+	}
+
+	if fn, ok := option("tostring").(*lua.LFunction); ok {
+		nw.writeString(nw.callToString(fn, node))
+		return
+	}
+
+	var prefix, suffix string
+	if v := option("prefix"); lua.LVAsBool(v) {
+		prefix = nw.L.ToStringMeta(v).String()
+	}
+	if v := option("suffix"); lua.LVAsBool(v) {
+		suffix = nw.L.ToStringMeta(v).String()
+	}
+
+	children, _ := node.RawGetString("children").(*lua.LTable)
+
+	if lua.LVAsBool(option("selfClosing")) && (children == nil || children.Len() == 0) {
+		nw.writeString(prefix + "<" + string(tag))
+		nw.writeAttrs(node.RawGetString("attrs"))
+		nw.writeString("/>" + suffix)
+		return
+	}
+
+	if tag != "" {
+		nw.writeString(prefix + "<" + string(tag))
+		nw.writeAttrs(node.RawGetString("attrs"))
+		nw.writeString(">")
+	}
+
+	if children != nil {
+		noEscape := lua.LVAsBool(option("noHTMLEscape"))
+		for k, sub := children.Next(lua.LNil); k != lua.LNil; k, sub = children.Next(k) {
+			if s, ok := sub.(lua.LString); ok {
+				if noEscape {
+					nw.writeString(string(s))
+				} else {
+					nw.writeString(htmlEscaper.Replace(string(s)))
+				}
+			} else {
+				nw.writeNode(sub)
+			}
+		}
+	}
+
+	if tag != "" {
+		nw.writeString("</" + string(tag) + ">" + suffix)
+	}
+}
+
+// See attrsToString in lua/html.lua
+func (nw *nodeWriter) writeAttrs(lv lua.LValue) {
+	attrs, ok := lv.(*lua.LTable)
+	if !ok {
+		return
+	}
+
+	if k, _ := attrs.Next(lua.LNil); k == lua.LNil {
+		return
+	}
+
+	// the entries are joined with a space, and prefixed with one
+	nw.writeString(" ")
+	separator := ""
+	for k, v := attrs.Next(lua.LNil); k != lua.LNil; k, v = attrs.Next(k) {
+		key, ok := k.(lua.LString)
+		if !ok {
+			continue
+		}
+		nw.writeString(separator)
+		separator = " "
+		name := attrEscaper.Replace(strings.ReplaceAll(string(key), "_", "-"))
+
+		switch v := v.(type) {
+		case *lua.LTable:
+			if name == "style" {
+				nw.writeString(name + `="` + attrEscaper.Replace(nw.styleToString(v)) + `"`)
+			} else {
+				nw.writeString(name + `="` + attrEscaper.Replace(nw.L.ToStringMeta(v).String()) + `"`)
+			}
+		case lua.LBool:
+			nw.writeString(name)
+		default:
+			nw.writeString(name + `="` + attrEscaper.Replace(nw.L.ToStringMeta(v).String()) + `"`)
+		}
+	}
+}
+
+// See styleToString in lua/html.lua
+func (nw *nodeWriter) styleToString(style *lua.LTable) string {
+	var declarations []string
+	for k, v := style.Next(lua.LNil); k != lua.LNil; k, v = style.Next(k) {
+		key, ok := k.(lua.LString)
+		if !ok {
+			nw.fail(fmt.Errorf("invalid declaration: %s", nw.L.ToStringMeta(k)))
+			return ""
+		}
+		name := strings.ReplaceAll(string(key), "_", "-")
+
+		switch v := v.(type) {
+		case lua.LNumber:
+			declarations = append(declarations, name+": "+v.String()+"px")
+		case lua.LString:
+			declarations = append(declarations, name+": "+string(v))
+		default:
+			nw.fail(fmt.Errorf("invalid value for %s: %s", name, v.Type()))
+			return ""
+		}
+	}
+	return strings.Join(declarations, "; ")
+}
+
+func (nw *nodeWriter) callToString(fn *lua.LFunction, node *lua.LTable) string {
+	L := nw.L
+	err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, node)
+	if err != nil {
+		nw.fail(err)
+		return ""
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+	if result == lua.LNil {
+		return ""
+	}
+	return L.ToStringMeta(result).String()
+}
+
+func (nw *nodeWriter) fail(err error) {
+	if nw.err == nil {
+		nw.err = err
+	}
+}
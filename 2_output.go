@@ -0,0 +1,126 @@
+package moontpl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// OutputProcessor post-processes the rendered output of a lua file,
+// such as formatting, minifying or validating it.
+// filename is the lua file that was rendered, such as /site/feed.xml.lua.
+type OutputProcessor func(ctx context.Context, filename string, output []byte) ([]byte, error)
+
+// RegisterOutputProcessor sets the processor for the output of the
+// lua files with the given extension, such as ".xml" for feed.xml.lua.
+// This replaces the existing processor, including the built-in ones
+// for ".html", ".css" and ".js". A nil fn removes the processor.
+// This must be called before rendering or building.
+//
+// Without a registered processor, the html output is formatted
+// while it's written. A registered processor gets the whole output
+// instead, so it's buffered.
+func (m *Moontpl) RegisterOutputProcessor(ext string, fn OutputProcessor) {
+	// a nil fn is kept, so that it also removes the built-in html formatting
+	m.outputProcessors[outputProcessorExt(ext)] = fn
+}
+
+// OutputProcessor returns the processor for the extension, or nil if there's none.
+// This can be used to wrap the built-in processors.
+func (m *Moontpl) OutputProcessor(ext string) OutputProcessor {
+	ext = outputProcessorExt(ext)
+	if fn, ok := m.outputProcessors[ext]; ok {
+		return fn
+	}
+	if ext == ".html" {
+		return m.processHTML
+	}
+	return nil
+}
+
+func outputProcessorExt(ext string) string {
+	ext = strings.TrimSuffix(strings.ToLower(ext), ".lua")
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// registerDefaultOutputProcessors registers the css and js minifiers.
+// The html output is handled by writeOutput, see processHTML.
+func (m *Moontpl) registerDefaultOutputProcessors() {
+	m.RegisterOutputProcessor(".css", m.minifyProcessor(minifyCSS))
+	m.RegisterOutputProcessor(".js", m.minifyProcessor(minifyJS))
+}
+
+// processHTML formats the html output, or minifies it
+// if the minify runtag is set. This is the built-in html
+// processor, but it's only used for minifying, or when it's
+// wrapped by another processor. Otherwise, writeOutput
+// formats the html as it's written.
+func (m *Moontpl) processHTML(ctx context.Context, filename string, output []byte) ([]byte, error) {
+	if m.hasRunTag(minifyRunTag) {
+		return []byte(minifyHTML(string(output))), nil
+	}
+	var buf bytes.Buffer
+	if err := formatHTML(&buf, bytes.NewReader(output)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *Moontpl) minifyProcessor(minify func(string) string) OutputProcessor {
+	return func(ctx context.Context, filename string, output []byte) ([]byte, error) {
+		if !m.hasRunTag(minifyRunTag) {
+			return output, nil
+		}
+		return []byte(minify(string(output))), nil
+	}
+}
+
+// writeOutput writes the value returned by a lua file to w.
+// If there's an output processor for the extension (and raw is false),
+// the output is buffered and passed to the processor first.
+// The html output is formatted while it's written, unless
+// it's minified or there's a registered processor.
+func (m *Moontpl) writeOutput(L *lua.LState, w io.Writer, ext, filename string, lv lua.LValue, raw bool) error {
+	ext = strings.ToLower(ext)
+	fn, ok := m.outputProcessors[ext]
+	if !ok && ext == ".html" && !raw {
+		if !m.hasRunTag(minifyRunTag) {
+			return writeFormattedHTML(L, w, lv)
+		}
+		fn = m.processHTML
+	}
+	if raw || fn == nil {
+		return writeLuaValue(L, w, lv)
+	}
+
+	var buf bytes.Buffer
+	if err := writeLuaValue(L, &buf, lv); err != nil {
+		return err
+	}
+
+	ctx := L.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	result, err := fn(ctx, filename, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(result)
+	return err
+}
+
+func writeLuaValue(L *lua.LState, w io.Writer, lv lua.LValue) error {
+	if isHTMLNode(L, lv) {
+		return writeHTMLNode(L, w, lv)
+	}
+	_, err := io.WriteString(w, L.ToStringMeta(lv).String())
+	return err
+}
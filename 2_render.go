@@ -1,29 +1,179 @@
 package moontpl
 
 import (
-	"github.com/nvlled/htmlformat"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
 	lua "github.com/yuin/gopher-lua"
 )
 
+// RenderOptions are the options for RenderTo.
+type RenderOptions struct {
+	// Raw skips the output processor of the file extension
+	// and the html formatting, the output is written as it is.
+	Raw bool
+
+	// Input is set as the page.input of the page, see Render.
+	Input any
+
+	// FS is where the page file is read from, instead of the OS filesystem.
+	FS fs.FS
+}
+
+// Render renders the lua file with input as the page.input.
+// This is for using a lua page as a template from Go.
+// The input is converted with ToLua, so structs, maps
+// and slices are deeply converted into lua tables.
+func (m *Moontpl) Render(filename string, input any) (string, error) {
+	return m.renderString(context.Background(), filename, RenderOptions{Input: input})
+}
+
+// RenderFS is like Render, but the lua file is read from fsys.
+func (m *Moontpl) RenderFS(fsys fs.FS, filename string, input any) (string, error) {
+	return m.renderString(context.Background(), filename, RenderOptions{Input: input, FS: fsys})
+}
+
 func (m *Moontpl) RenderFile(filename string) (string, error) {
+	return m.RenderFileContext(context.Background(), filename)
+}
+
+// RenderFileContext is like RenderFile, but the rendering
+// is stopped with an error when ctx is cancelled.
+func (m *Moontpl) RenderFileContext(ctx context.Context, filename string) (string, error) {
+	return m.renderString(ctx, filename, RenderOptions{})
+}
+
+func (m *Moontpl) renderString(ctx context.Context, filename string, opts RenderOptions) (string, error) {
+	var buf strings.Builder
+	if err := m.RenderToContext(ctx, &buf, filename, opts); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// RenderTo renders the lua file and writes the output to w.
+// The html nodes returned by the file are serialized straight
+// to w, instead of being converted to a single string first.
+// The html is also formatted as it's written. The whole output
+// is only buffered when it's minified or when it needs
+// to be passed to a registered output processor.
+func (m *Moontpl) RenderTo(w io.Writer, filename string, opts RenderOptions) error {
+	return m.RenderToContext(context.Background(), w, filename, opts)
+}
+
+// RenderToContext is like RenderTo, but the rendering
+// is stopped with an error when ctx is cancelled.
+func (m *Moontpl) RenderToContext(ctx context.Context, w io.Writer, filename string, opts RenderOptions) error {
 	L := m.getState(filename)
-	defer m.luaPool.Put(L)
 
-	lv, err := m.renderFile(L, filename)
+	var err error
+	ok := runWithContext(ctx, L, func() {
+		err = m.renderTo(L, w, filename, opts)
+	})
+	if ok {
+		m.putState(L)
+	} else {
+		L.Close()
+	}
+
+	return renderContextError(ctx, filename, err)
+}
+
+// renderTimeoutContext returns a context with the RenderTimeout,
+// for rendering a single page. Without a timeout, ctx itself is
+// returned so that runWithContext can skip the context checks
+// when ctx can't be cancelled.
+func (m *Moontpl) renderTimeoutContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.RenderTimeout > 0 {
+		return context.WithTimeout(ctx, m.RenderTimeout)
+	}
+	return ctx, func() {}
+}
+
+// runWithContext runs fn with ctx set on L, so that the lua code is stopped
+// when ctx is cancelled. It returns false if ctx was cancelled,
+// in which case L is in an unknown state and must not be reused.
+func runWithContext(ctx context.Context, L *lua.LState, fn func()) bool {
+	if ctx.Done() == nil {
+		// not cancellable, skip the overhead of checking the context
+		fn()
+		return true
+	}
+
+	L.SetContext(ctx)
+	fn()
+	if ctx.Err() != nil {
+		return false
+	}
+	L.RemoveContext()
+	return true
+}
+
+// renderContextError replaces the error raised by lua
+// when ctx is cancelled with one that names the page.
+func renderContextError(ctx context.Context, filename string, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("render of %s timed out: %w", filename, ctx.Err())
+	}
+	return fmt.Errorf("render of %s was cancelled: %w", filename, ctx.Err())
+}
+
+func (m *Moontpl) renderTo(L *lua.LState, w io.Writer, filename string, opts RenderOptions) (err error) {
+	defer func() { err = newRenderError(filename, err) }()
+
+	return protectedCall(L, func() error {
+		return m.renderOutput(L, w, filename, opts)
+	})
+}
+
+// protectedCall runs fn in a protected lua call. The lua errors that are
+// raised outside of a lua call, such as by a __tostring metamethod while
+// the output is written, are panics. These are returned as a *lua.ApiError
+// instead, and the lua stack is restored so the state can still be used.
+func protectedCall(L *lua.LState, fn func() error) error {
+	var err error
+	callErr := L.CallByParam(lua.P{
+		Fn: L.NewFunction(func(L *lua.LState) int {
+			err = fn()
+			return 0
+		}),
+		Protect: true,
+	})
+	if callErr != nil {
+		return callErr
+	}
+	return err
+}
+
+func (m *Moontpl) renderOutput(L *lua.LState, w io.Writer, filename string, opts RenderOptions) error {
+	lv, err := m.renderFile(L, filename, opts)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	if lv.Type() == lua.LTNil {
-		return "", nil
+		return nil
 	}
 
-	output := L.ToStringMeta(lv).String()
-	if wholeExt(filename) == ".html.lua" {
-		output = htmlformat.Format(output)
+	ext := filepath.Ext(strings.TrimSuffix(filename, ".lua"))
+
+	if tbl, ok := lv.(*lua.LTable); ok && isDataOutput(ext) && L.GetMetaField(tbl, "__tostring") == lua.LNil {
+		output, err := m.encodeDataOutput(L, ext, tbl)
+		if err != nil {
+			return err
+		}
+		lv = lua.LString(output)
 	}
 
-	return output, nil
+	return m.writeOutput(L, w, ext, filename, lv, opts.Raw)
 }
 
 func (m *Moontpl) RenderString(luaCode string) (string, error) {
@@ -39,24 +189,62 @@ func (m *Moontpl) RenderString(luaCode string) (string, error) {
 		return "", nil
 	}
 
-	output := L.ToStringMeta(lv).String()
-	output = htmlformat.Format(output)
+	var buf strings.Builder
+	err := protectedCall(L, func() error {
+		return m.writeOutput(L, &buf, ".html", "-", lv, false)
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// doFile runs the lua file, which is read from fsys if it's not nil.
+func (m *Moontpl) doFile(L *lua.LState, fsys fs.FS, filename string) error {
+	if fsys == nil {
+		return m.doSiteFile(L, filename)
+	}
 
-	return output, nil
+	file, err := fsys.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fn, err := L.Load(file, filename)
+	if err != nil {
+		return err
+	}
+	L.Push(fn)
+	return L.PCall(0, lua.MultRet, nil)
 }
 
-func (m *Moontpl) renderFile(L *lua.LState, filename string) (lua.LValue, error) {
+func (m *Moontpl) renderFile(L *lua.LState, filename string, opts RenderOptions) (lua.LValue, error) {
+	page, _ := getLoadedModule(L, "page").(*lua.LTable)
+
+	if opts.Input != nil && page != nil {
+		input, err := ToLua(L, opts.Input)
+		if err != nil {
+			return lua.LNil, fmt.Errorf("invalid input for %s: %w", filename, err)
+		}
+		L.SetField(page, "input", input)
+	}
+
 	if hasPathParams(filename) {
 		var params pathParams
 		params, filename = extractPathParams(filename)
-		pageData := PageData{}
-		for k, v := range params {
-			pageData[k] = v
+
+		// the path params are added to the page.input
+		if page != nil {
+			if input, ok := page.RawGetString("input").(*lua.LTable); ok {
+				for k, v := range params {
+					input.RawSetString(k, lua.LString(v))
+				}
+			}
 		}
-		m.SetPageData(L, pageData)
 	}
 
-	if err := L.DoFile(filename); err != nil {
+	if err := m.doFile(L, opts.FS, filename); err != nil {
 		return lua.LNil, err
 	}
 
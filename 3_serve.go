@@ -1,10 +1,13 @@
 package moontpl
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"html"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -13,28 +16,167 @@ import (
 	"strings"
 )
 
-func (m *Moontpl) Serve(addr string) {
+// ErrorPageStyle is how the Handler responds to pages that fail to render.
+type ErrorPageStyle int
+
+const (
+	// ErrorPagePlain responds with a generic 500 Internal Server Error
+	// without the error details, which are only logged. This is the default.
+	ErrorPagePlain ErrorPageStyle = iota
+
+	// ErrorPageDetailed shows the error message and the lua source
+	// around the error location. This is what the dev server uses.
+	ErrorPageDetailed
+)
+
+// HandlerOptions configures the http.Handler returned by Handler.
+type HandlerOptions struct {
+	// LiveReload serves the event stream that the page reload script
+	// listens to. Events are only sent while the file watcher runs,
+	// as with moontpl serve.
+	LiveReload bool
+
+	// ErrorPage is how rendering errors are shown.
+	ErrorPage ErrorPageStyle
+
+	// Fallback handles the requests that are not for pages.
+	// If nil, the files in SiteDir are served.
+	Fallback http.Handler
+}
+
+// Serve starts the dev server at addr, with live reload and detailed
+// error pages. It blocks until the server is stopped by Shutdown,
+// in which case nil is returned.
+func (m *Moontpl) Serve(addr string) error {
+	m.serverMu.Lock()
+	m.serverStarting = true
+	m.serverMu.Unlock()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		m.serverMu.Lock()
+		m.serverStarting = false
+		m.shutdownRequested = false
+		m.serverMu.Unlock()
+		return err
+	}
+	log.Printf("server listening at http://%s%s/", addr, m.basePath())
+	return m.serve(listener)
+}
+
+// serve is Serve with a listener that's already open.
+// The listener is closed when serve returns.
+func (m *Moontpl) serve(listener net.Listener) error {
+	// the live reload streams never end by themselves,
+	// so they are cancelled when the server shuts down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	server := &http.Server{
-		Addr:    addr,
-		Handler: m.createHTTPHandler(),
+		Handler:     m.Handler(HandlerOptions{LiveReload: true, ErrorPage: ErrorPageDetailed}),
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
+	server.RegisterOnShutdown(cancel)
+
+	m.serverMu.Lock()
+	requested := m.shutdownRequested
+	m.serverStarting = false
+	m.shutdownRequested = false
+	if requested {
+		// Shutdown was called while Serve was starting
+		m.serverMu.Unlock()
+		return listener.Close()
+	}
+	m.server = server
+	m.serverMu.Unlock()
+
+	defer func() {
+		m.serverMu.Lock()
+		if m.server == server {
+			m.server = nil
+		}
+		m.serverMu.Unlock()
+	}()
 
-	log.Printf("server listening at http://%s", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
-		panic(err)
+	err := server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
 	}
+	return err
 }
 
-func (m *Moontpl) createHTTPHandler() http.Handler {
-	pageDir := http.FileServer(http.Dir(m.SiteDir))
+// Shutdown gracefully stops the server started by Serve, waiting for
+// the requests in progress to finish until ctx is done.
+// If Serve is still starting in another goroutine, it returns
+// right away instead. Otherwise, Shutdown does nothing when no
+// server is running.
+func (m *Moontpl) Shutdown(ctx context.Context) error {
+	m.serverMu.Lock()
+	server := m.server
+	m.server = nil
+	if server == nil && m.serverStarting {
+		m.shutdownRequested = true
+	}
+	m.serverMu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+// Handler returns an http.Handler that renders the pages on each request,
+// for embedding the site in another server. If BasePath is set,
+// the handler expects the full request path, such as /docs/about.html,
+// so it can be mounted without http.StripPrefix.
+func (m *Moontpl) Handler(opts HandlerOptions) http.Handler {
+	handler := m.createSiteHandler(opts)
+	base := m.basePath()
+	if base == "" {
+		return handler
+	}
+
+	// mount the site under the base path, like where it will be deployed
+	siteHandler := http.StripPrefix(base, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == reloadFilename:
+			handler.ServeHTTP(w, r)
+		case r.URL.Path == "/" || r.URL.Path == base:
+			http.Redirect(w, r, base+"/", http.StatusFound)
+		default:
+			siteHandler.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (m *Moontpl) createSiteHandler(opts HandlerOptions) http.Handler {
+	pageDir := opts.Fallback
+	if pageDir == nil {
+		pageDir = http.FileServer(http.FS(m.siteFS()))
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		pagePath := path.Clean(r.URL.Path)
 
-		if pagePath == reloadFilename {
+		// the reload script requests .modified relative to the page,
+		// so that it works wherever the handler is mounted
+		if path.Base(pagePath) == path.Base(reloadFilename) && opts.LiveReload {
 			m.handleCheckModified(w, r)
 			return
 		}
 
+		if m.PrettyURLs {
+			if target, ok := m.prettyURLRedirect(r.URL.Path); ok {
+				target = m.basePath() + target
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, http.StatusMovedPermanently)
+				return
+			}
+			pagePath = path.Clean(m.pageLinkFromURL(r.URL.Path))
+		}
+
 		var filename string
 		if pagePath == "/" {
 			filename = path.Join(m.SiteDir, "index.html.lua")
@@ -42,9 +184,9 @@ func (m *Moontpl) createHTTPHandler() http.Handler {
 			filename = path.Join(m.SiteDir, pagePath)
 		}
 
-		stat, err := fsStat(filename)
+		stat, err := m.statSiteFile(filename)
 		if err != nil && !errors.Is(err, os.ErrNotExist) {
-			respondInternalError(w, err)
+			m.respondInternalError(w, err, opts)
 			return
 		}
 
@@ -54,7 +196,7 @@ func (m *Moontpl) createHTTPHandler() http.Handler {
 			filename += ".lua"
 		}
 
-		if filepath.Ext(filename) == ".lua" && !fsExists(filename) && !hasPathParams(filename) {
+		if filepath.Ext(filename) == ".lua" && !m.siteFileExists(filename) && !hasPathParams(filename) {
 			r.URL.Path = path.Join("/", r.URL.Path)
 			log.Println("serve file:", r.URL.Path)
 			pageDir.ServeHTTP(w, r)
@@ -62,31 +204,80 @@ func (m *Moontpl) createHTTPHandler() http.Handler {
 		}
 
 		log.Println("run file:", filename)
-		output, err := m.RenderFile(filename)
-		if err != nil {
-			respondInternalError(w, err)
-			return
-		}
+		contentType := apply2(strings.TrimSuffix(filename, ".lua"), filepath.Ext, contentTypeByExtension)
+		rw := &renderResponseWriter{w: w, contentType: contentType}
 
-		ext := apply2(strings.TrimSuffix(filename, ".lua"), filepath.Ext, mime.TypeByExtension)
+		ctx, cancel := m.renderTimeoutContext(r.Context())
+		defer cancel()
 
-		w.Header().Add("Content-Type", ext)
-		_, err = w.Write([]byte(output))
+		err = m.RenderToContext(ctx, rw, filename, RenderOptions{})
+		if err == nil && !rw.written {
+			w.Header().Add("Content-Type", contentType)
+		}
 		if err != nil {
-			respondInternalError(w, err)
+			if !rw.written {
+				m.respondInternalError(w, err, opts)
+				return
+			}
+			// too late for an error page, the output is already partially sent
+			log.Print(err)
 		}
 	})
 }
 
-func respondInternalError(w http.ResponseWriter, err error) {
+// renderResponseWriter sets the content type on the first write,
+// so that an error page can still be sent if the rendering
+// fails before any output is written.
+type renderResponseWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	written     bool
+}
+
+func (rw *renderResponseWriter) Write(p []byte) (int, error) {
+	if !rw.written {
+		rw.written = true
+		rw.w.Header().Add("Content-Type", rw.contentType)
+	}
+	return rw.w.Write(p)
+}
+
+func (m *Moontpl) respondInternalError(w http.ResponseWriter, err error, opts HandlerOptions) {
+	log.Print(err)
+
+	if opts.ErrorPage == ErrorPagePlain {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var renderErr *RenderError
+	isRenderError := errors.As(err, &renderErr)
+
+	var excerpts string
+	if isRenderError {
+		excerpts = m.renderErrorExcerpts(renderErr)
+	}
+
+	var reloadScript string
+	if opts.LiveReload {
+		reloadScript = `<script>
+	window.addEventListener("load", function() {
+		new EventSource('.modified').onmessage = function(event) {
+			window.location.reload();
+		};
+	});
+</script>`
+	}
+
 	w.Header().Add("Content-Type", "text/html")
 	w.WriteHeader(http.StatusInternalServerError)
 	fmt.Fprintf(w, `
 <!DOCTYPE html>
 <html>
 <pre>
-%v
+%s
 </pre>
+%s
 <style>
 pre {
 	white-space: pre-wrap;
@@ -96,16 +287,86 @@ body {
 	color: #f00;
 	background: #222;
 }
+.location {
+	margin-top: 1em;
+	color: #ccc;
+}
+.excerpt {
+	color: #aaa;
+	white-space: pre;
+	background: #111;
+	padding: 0.5em;
+	overflow-x: auto;
+}
+.excerpt .error-line {
+	color: #fff;
+	background: #622;
+}
 </style>
-<script>
-	window.addEventListener("load", function() {
-		new EventSource('/.modified').onmessage = function(event) {
-			window.location.reload();
-		};
-	});
-</script>
+%s
 </html>
-	`, err)
-	log.Print(err)
-	debug.PrintStack()
+	`, html.EscapeString(err.Error()), excerpts, reloadScript)
+
+	// the go stack trace is of no use for errors in the lua code
+	if !isRenderError {
+		debug.PrintStack()
+	}
+}
+
+// renderErrorExcerpts shows the source lines around each frame of the error.
+func (m *Moontpl) renderErrorExcerpts(err *RenderError) string {
+	const contextLines = 3
+
+	var buf strings.Builder
+	for _, frame := range err.Frames {
+		fmt.Fprintf(&buf, `<div class="location">%s:%d: in %s</div>`,
+			html.EscapeString(frame.File), frame.Line, html.EscapeString(frame.Function))
+
+		contents, readErr := m.readSiteFile(frame.File)
+		if readErr != nil || frame.Line <= 0 {
+			continue
+		}
+
+		lines := strings.Split(string(contents), "\n")
+		start := max(frame.Line-contextLines, 1)
+		end := min(frame.Line+contextLines, len(lines))
+
+		buf.WriteString(`<pre class="excerpt">`)
+		for i := start; i <= end; i++ {
+			class := "line"
+			if i == frame.Line {
+				class += " error-line"
+			}
+			fmt.Fprintf(&buf, `<div class="%s">%4d  %s</div>`, class, i, html.EscapeString(lines[i-1]))
+		}
+		buf.WriteString(`</pre>`)
+	}
+	return buf.String()
+}
+
+// contentTypes are the types that may be missing from the system mime database.
+var contentTypes = map[string]string{
+	".json": "application/json",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+}
+
+func contentTypeByExtension(ext string) string {
+	if t, ok := contentTypes[strings.ToLower(ext)]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// prettyURLRedirect returns the pretty URL of a page requested
+// as /about.html or /about, so that relative links still work.
+func (m *Moontpl) prettyURLRedirect(urlPath string) (string, bool) {
+	if path.Ext(urlPath) == ".html" {
+		if target := m.outputLink(urlPath); target != urlPath && m.pageExists(urlPath) {
+			return target, true
+		}
+	} else if path.Ext(urlPath) == "" && !strings.HasSuffix(urlPath, "/") && m.pageExists(urlPath+".html") {
+		return urlPath + "/", true
+	}
+	return "", false
 }
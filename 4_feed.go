@@ -0,0 +1,331 @@
+package moontpl
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type feedEntry struct {
+	Title   string
+	Link    string
+	ID      string
+	Desc    string
+	Content string
+	Author  string
+	Date    time.Time
+}
+
+type feed struct {
+	Title    string
+	Link     string
+	SelfLink string
+	ID       string
+	Desc     string
+	Author   string
+	Updated  time.Time
+	Entries  []feedEntry
+}
+
+var feedDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+}
+
+func parseFeedDate(lv lua.LValue) (time.Time, error) {
+	switch v := lv.(type) {
+	case lua.LNumber:
+		return time.Unix(int64(v), 0).UTC(), nil
+	case lua.LString:
+		s := strings.TrimSpace(string(v))
+		for _, layout := range feedDateLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid date: %q", s)
+	}
+	return time.Time{}, fmt.Errorf("invalid date: %v", lv)
+}
+
+// readFeed reads the feed options from lua. pageLink is the
+// link of the feed page, used for resolving relative links.
+func (m *Moontpl) readFeed(L *lua.LState, options *lua.LTable, pageLink string) (*feed, error) {
+	siteURL := m.SiteURL
+	if s := luaString(L, options, "siteURL"); s != "" {
+		siteURL = s
+	}
+
+	absURL := func(link string) (string, error) {
+		u, err := url.Parse(link)
+		if err != nil {
+			return "", err
+		}
+		if u.IsAbs() {
+			return link, nil
+		}
+		if siteURL == "" {
+			return "", fmt.Errorf("cannot make absolute URL for %q: siteURL is not set", link)
+		}
+		u.Path = m.outputLink(m.stripBasePath(absoluteLink(pageLink, u.Path)))
+		return m.siteBaseURL(siteURL) + u.String(), nil
+	}
+
+	var err error
+	result := &feed{
+		Title:  luaString(L, options, "title"),
+		Desc:   luaString(L, options, "desc"),
+		Author: luaString(L, options, "author"),
+		ID:     luaString(L, options, "id"),
+	}
+	if result.Link, err = absURL(luaString(L, options, "link")); err != nil {
+		return nil, err
+	}
+	if result.SelfLink, err = absURL(pageLink); err != nil {
+		return nil, err
+	}
+	if result.ID == "" {
+		result.ID = result.Link
+	}
+	if updated := options.RawGetString("updated"); updated != lua.LNil {
+		if result.Updated, err = parseFeedDate(updated); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, ok := options.RawGetString("entries").(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("feed entries must be a table")
+	}
+
+	for i := 1; i <= entries.Len(); i++ {
+		// a table, or a PageEntry from page.list()
+		item, ok := entries.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return nil, fmt.Errorf("invalid feed entry #%d", i)
+		}
+		data, _ := item.RawGetString("data").(*lua.LTable)
+
+		get := func(key string) lua.LValue {
+			if lv := item.RawGetString(key); lv != lua.LNil {
+				return lv
+			}
+			if data != nil {
+				return data.RawGetString(key)
+			}
+			return lua.LNil
+		}
+		getString := func(key string) string {
+			if lv := get(key); lv != lua.LNil {
+				return L.ToStringMeta(lv).String()
+			}
+			return ""
+		}
+
+		entry := feedEntry{
+			Title:   getString("title"),
+			ID:      getString("id"),
+			Desc:    getString("desc"),
+			Content: getString("content"),
+			Author:  getString("author"),
+		}
+		if entry.Link, err = absURL(getString("link")); err != nil {
+			return nil, err
+		}
+		if entry.ID == "" {
+			entry.ID = entry.Link
+		}
+		if date := get("date"); date != lua.LNil {
+			if entry.Date, err = parseFeedDate(date); err != nil {
+				return nil, fmt.Errorf("feed entry %q: %w", entry.Title, err)
+			}
+		}
+		if entry.Date.After(result.Updated) {
+			result.Updated = entry.Date
+		}
+
+		result.Entries = append(result.Entries, entry)
+	}
+
+	// the build time would make the feed differ on every build
+	if result.Updated.IsZero() {
+		return nil, fmt.Errorf("the feed has no date, set the updated option or the date of the entries")
+	}
+
+	return result, nil
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"feed"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Author   *atomPerson `xml:"author,omitempty"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Summary *atomText   `xml:"summary,omitempty"`
+	Content *atomText   `xml:"content,omitempty"`
+}
+
+func (f *feed) atom() ([]byte, error) {
+	result := atomFeed{
+		Xmlns:    "http://www.w3.org/2005/Atom",
+		Title:    f.Title,
+		Subtitle: f.Desc,
+		ID:       f.ID,
+		Updated:  f.Updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: f.Link},
+			{Href: f.SelfLink, Rel: "self"},
+		},
+	}
+	if f.Author != "" {
+		result.Author = &atomPerson{Name: f.Author}
+	}
+
+	for _, e := range f.Entries {
+		entry := atomEntry{
+			Title:   e.Title,
+			ID:      e.ID,
+			Updated: f.Updated.Format(time.RFC3339),
+			Link:    atomLink{Href: e.Link},
+		}
+		if !e.Date.IsZero() {
+			entry.Updated = e.Date.Format(time.RFC3339)
+		}
+		if e.Author != "" {
+			entry.Author = &atomPerson{Name: e.Author}
+		}
+		if e.Desc != "" {
+			entry.Summary = &atomText{Body: e.Desc}
+		}
+		if e.Content != "" {
+			entry.Content = &atomText{Type: "html", Body: e.Content}
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+
+	return marshalFeed(result)
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	XmlnsDC string     `xml:"xmlns:dc,attr,omitempty"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate,omitempty"`
+	Author      string  `xml:"author,omitempty"`
+	Creator     string  `xml:"dc:creator,omitempty"`
+	Description string  `xml:"description,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func (f *feed) rss() ([]byte, error) {
+	desc := f.Desc
+	if desc == "" {
+		desc = f.Title
+	}
+
+	result := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          f.Link,
+			Description:   desc,
+			LastBuildDate: f.Updated.Format(time.RFC1123Z),
+		},
+	}
+
+	for _, e := range f.Entries {
+		item := rssItem{
+			Title:       e.Title,
+			Link:        e.Link,
+			GUID:        rssGUID{IsPermaLink: e.ID == e.Link, Value: e.ID},
+			Description: e.Desc,
+		}
+		// the RSS author is an email address, other names use dc:creator
+		if strings.Contains(e.Author, "@") {
+			item.Author = e.Author
+		} else if e.Author != "" {
+			item.Creator = e.Author
+			result.XmlnsDC = "http://purl.org/dc/elements/1.1/"
+		}
+		if e.Content != "" {
+			item.Description = e.Content
+		}
+		if !e.Date.IsZero() {
+			item.PubDate = e.Date.Format(time.RFC1123Z)
+		}
+		result.Channel.Items = append(result.Channel.Items, item)
+	}
+
+	return marshalFeed(result)
+}
+
+func marshalFeed(v any) ([]byte, error) {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+func luaString(L *lua.LState, t *lua.LTable, key string) string {
+	if lv := t.RawGetString(key); lv != lua.LNil {
+		return L.ToStringMeta(lv).String()
+	}
+	return ""
+}
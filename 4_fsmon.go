@@ -1,6 +1,7 @@
 package moontpl
 
 import (
+	"errors"
 	"io/fs"
 	"log"
 	"net/http"
@@ -100,25 +101,27 @@ func (m *Moontpl) startFsWatch() error {
 		}
 	}()
 
-	err = fs.WalkDir(os.DirFS(m.SiteDir), ".", func(p string, dir fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if p != "." && p[0] == '.' {
-			return nil
-		}
-		if dir.IsDir() {
-			filename := filepath.Join(m.SiteDir, p)
-			log.Print("watching dir: ", filename)
-			if err = watcher.Add(filename); err != nil {
+	for _, siteDir := range append([]string{m.SiteDir}, m.themeDirs...) {
+		err = fs.WalkDir(os.DirFS(siteDir), ".", func(p string, dir fs.DirEntry, err error) error {
+			if err != nil {
 				return err
 			}
-		}
+			if p != "." && p[0] == '.' {
+				return nil
+			}
+			if dir.IsDir() {
+				filename := filepath.Join(siteDir, p)
+				log.Print("watching dir: ", filename)
+				if err = watcher.Add(filename); err != nil {
+					return err
+				}
+			}
 
-		return nil
-	})
-	if err != nil {
-		return err
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	if fsExists("./lua") {
@@ -142,14 +145,24 @@ func (m *Moontpl) handleCheckModified(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
+	// send the headers now, the first event may take a while
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		log.Print("live reload: ", err)
+		if errors.Is(err, http.ErrNotSupported) {
+			http.Error(w, "live reload needs a response writer that can be flushed", http.StatusInternalServerError)
+		}
+		return
+	}
 
 	fsID := m.fsWatcher.On(func(link string) {
 		resp := "event: message\ndata: _\n\n"
 		_, err := w.Write([]byte(resp))
+		if err == nil {
+			err = rc.Flush()
+		}
 		if err != nil {
-			log.Print(err)
-		} else {
-			w.(http.Flusher).Flush()
+			log.Print("live reload: ", err)
 		}
 	})
 
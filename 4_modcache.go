@@ -3,6 +3,7 @@ package moontpl
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
@@ -10,6 +11,16 @@ import (
 )
 
 const dependencyIndex = lua.LNumber(-9988002)
+const dependencyTrackerIndex = lua.LNumber(-9988003)
+
+// Pseudo-modules for pages that depend on the contents
+// or listing of the SITEDIR, such as page.list() or site.files(),
+// or on the fingerprinted asset names, as in path.asset().
+const (
+	pagesDependency  = "@pages"
+	filesDependency  = "@files"
+	assetsDependency = "@assets"
+)
 
 type dependencyTable lua.LTable
 
@@ -54,6 +65,21 @@ func (dt *dependencyTable) GetDependentsOf(moduleName string) []string {
 	return result
 }
 
+func (dt *dependencyTable) GetDependenciesOf(moduleName string) []string {
+	t := (*lua.LTable)(dt)
+	var result []string
+	t.ForEach(func(k, v lua.LValue) {
+		name, ok := k.(lua.LString)
+		if !ok {
+			return
+		}
+		if dependents, ok := v.(*lua.LTable); ok && dependents.RawGetString(moduleName) != lua.LNil {
+			result = append(result, string(name))
+		}
+	})
+	return result
+}
+
 func (dt *dependencyTable) ClearParent(moduleName string) {
 	t := (*lua.LTable)(dt)
 	t.ForEach(func(k, v lua.LValue) {
@@ -81,6 +107,9 @@ type DependencyTracker struct {
 	lineage    []string
 	dependents *dependencyTable
 	require    *lua.LFunction
+
+	// modules that are directly used by the page being rendered
+	used map[string]struct{}
 }
 
 func newDepdencyTracker(L *lua.LState) *DependencyTracker {
@@ -88,11 +117,70 @@ func newDepdencyTracker(L *lua.LState) *DependencyTracker {
 		level:      0,
 		lineage:    []string{},
 		dependents: (*dependencyTable)(L.NewTable()),
+		used:       map[string]struct{}{},
 	}
 	L.G.Registry.RawSet(dependencyIndex, (*lua.LTable)(self.dependents))
+	L.G.Registry.RawSet(dependencyTrackerIndex, &lua.LUserData{Value: self})
 	return self
 }
 
+func getDependencyTracker(L *lua.LState) *DependencyTracker {
+	if ud, ok := L.G.Registry.RawGet(dependencyTrackerIndex).(*lua.LUserData); ok {
+		if dt, ok := ud.Value.(*DependencyTracker); ok {
+			return dt
+		}
+	}
+	return nil
+}
+
+// AddDependency records that the module currently being loaded,
+// or the page if there is none, depends on the given module.
+func (dt *DependencyTracker) AddDependency(L *lua.LState, moduleName string) {
+	if len(dt.lineage) >= 1 {
+		dt.dependents.AddDependentOf(L, moduleName, dt.lineage[len(dt.lineage)-1])
+	} else {
+		dt.used[moduleName] = struct{}{}
+	}
+}
+
+func trackDependency(L *lua.LState, moduleName string) {
+	if dt := getDependencyTracker(L); dt != nil {
+		dt.AddDependency(L, moduleName)
+	}
+}
+
+// ResetUsed clears the modules used by the previous page.
+func (dt *DependencyTracker) ResetUsed() {
+	clear(dt.used)
+}
+
+// GetPageDependencies returns all the modules that the current page
+// depends on, including the indirect ones.
+func (dt *DependencyTracker) GetPageDependencies() []string {
+	var queue []string
+	for name := range dt.used {
+		queue = append(queue, name)
+	}
+
+	var result []string
+	visited := map[string]struct{}{}
+	for len(queue) > 0 {
+		name := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		if _, ok := visited[name]; ok {
+			continue
+		}
+		visited[name] = struct{}{}
+
+		result = append(result, name)
+		queue = append(queue, dt.dependents.GetDependenciesOf(name)...)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
 func getModuleName(siteDir, modpath string) string {
 	modpath = strings.TrimPrefix(modpath, siteDir)
 	modpath = strings.TrimSuffix(modpath, ".lua")
@@ -106,11 +194,9 @@ func getModuleName(siteDir, modpath string) string {
 func (dt *DependencyTracker) wrap(m *Moontpl, fn lua.LGFunction) lua.LGFunction {
 	return func(L *lua.LState) int {
 		track := L.OptBool(2, true)
-		if !moontpl.disableLuaPool && track {
+		if !m.disableLuaPool && track {
 			name := getModuleName(m.SiteDir, L.ToString(1))
-			if len(dt.lineage) >= 1 {
-				dt.dependents.AddDependentOf(L, name, dt.lineage[len(dt.lineage)-1])
-			}
+			dt.AddDependency(L, name)
 
 			dt.level++
 			dt.lineage = append(dt.lineage, name)
@@ -2,6 +2,8 @@ package moontpl
 
 import (
 	"io/fs"
+	"net/url"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -13,6 +15,10 @@ type PagePath struct {
 	AbsFile string `luar:"absFile"`
 	RelFile string `luar:"relFile"`
 	Link    string `luar:"link"`
+
+	// Layer is the site or theme directory that the page comes from.
+	// It's only set for the pages listed by GetPageFilenames.
+	Layer string `luar:"layer"`
 }
 
 type Page struct {
@@ -22,10 +28,7 @@ type Page struct {
 
 func (m *Moontpl) getNonHtmlLuaFilenames(baseDir string) ([]PagePath, error) {
 	var result []PagePath
-	err := filepath.WalkDir(baseDir, func(filename string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+	err := m.walkSiteDir(baseDir, func(filename string, d fs.DirEntry) error {
 		if filepath.Ext(filename) == ".lua" && wholeExt(filename) != ".html.lua" {
 			result = append(result, m.getPagePath(filename))
 		}
@@ -36,12 +39,13 @@ func (m *Moontpl) getNonHtmlLuaFilenames(baseDir string) ([]PagePath, error) {
 
 func (m *Moontpl) GetPageFilenames(baseDir string) ([]PagePath, error) {
 	var result []PagePath
-	err := filepath.WalkDir(baseDir, func(filename string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+	err := m.walkSiteDir(baseDir, func(filename string, d fs.DirEntry) error {
 		if strings.HasSuffix(filename, ".html.lua") {
-			result = append(result, m.getPagePath(filename))
+			pagePath := m.getPagePath(filename)
+			if p, ok := m.sitePath(filename); ok {
+				pagePath.Layer = m.fileLayer(p)
+			}
+			result = append(result, pagePath)
 		}
 		return nil
 	})
@@ -54,6 +58,14 @@ func (m *Moontpl) GetPages() ([]Page, error) {
 	L := m.createState(false)
 	defer L.Close()
 
+	// the site data is still needed, such as for the titles in the layouts
+	L.PreloadModule("site", func(L *lua.LState) int {
+		mod := m.loadDefaultTableModule(L, "site")
+		L.SetField(mod, "data", mustToLua(L, m.SiteData))
+		L.Push(mod)
+		return 1
+	})
+
 	// disable printing
 	L.DoString("print = function() end")
 
@@ -65,7 +77,7 @@ func (m *Moontpl) GetPages() ([]Page, error) {
 	}
 
 	for _, entry := range filenames {
-		data, err := getReturnedPageData(L, entry.AbsFile)
+		data, err := m.getReturnedPageData(L, entry.AbsFile)
 		if err != nil {
 			return nil, err
 		}
@@ -91,12 +103,16 @@ func (m *Moontpl) getPagePath(filename string) PagePath {
 	}
 }
 
-func getReturnedPageData(L *lua.LState, filename string) (*lua.LTable, error) {
-	if err := L.DoFile(filename); err != nil {
+func (m *Moontpl) getReturnedPageData(L *lua.LState, filename string) (*lua.LTable, error) {
+	if err := m.doSiteFile(L, filename); err != nil {
 		return L.NewTable(), err
 	}
 
-	page := getLoadedModule(L, "page").(*lua.LTable)
+	// the page module is not loaded if the page doesn't use it
+	page, ok := getLoadedModule(L, "page").(*lua.LTable)
+	if !ok {
+		return L.NewTable(), nil
+	}
 
 	if data, ok := page.RawGetString("data").(*lua.LTable); ok {
 		result := L.NewTable()
@@ -109,3 +125,146 @@ func getReturnedPageData(L *lua.LState, filename string) (*lua.LTable, error) {
 
 	return L.NewTable(), nil
 }
+
+// splitLink splits the link into its path and its query/fragment suffix.
+func splitLink(link string) (string, string) {
+	if i := strings.IndexAny(link, "?#"); i >= 0 {
+		return link[:i], link[i:]
+	}
+	return link, ""
+}
+
+// isLocalLink returns true if the link refers to a file in the site,
+// as opposed to external URLs, schemes like mailto: and fragment-only links.
+func isLocalLink(link string) bool {
+	if link == "" || link[0] == '#' || link[0] == '?' || strings.HasPrefix(link, "//") || strings.Contains(link, "://") {
+		return false
+	}
+	if i := strings.Index(link, ":"); i >= 0 && !strings.ContainsAny(link[:i], "/?#") {
+		return false
+	}
+	return true
+}
+
+// outputFile returns the path of the output file of a page link,
+// relative to the output directory.
+// With PrettyURLs, /about.html is written to /about/index.html.
+func (m *Moontpl) outputFile(link string) string {
+	if !m.PrettyURLs || path.Ext(link) != ".html" || path.Base(link) == "index.html" {
+		return link
+	}
+	return strings.TrimSuffix(link, ".html") + "/index.html"
+}
+
+// outputLink returns the URL where a page link is served.
+// With PrettyURLs, /about.html becomes /about/ and /dir/index.html becomes /dir/.
+func (m *Moontpl) outputLink(link string) string {
+	p, suffix := splitLink(link)
+	if !m.PrettyURLs || path.Ext(p) != ".html" {
+		return link
+	}
+	if path.Base(p) == "index.html" {
+		return strings.TrimSuffix(p, "index.html") + suffix
+	}
+	return strings.TrimSuffix(p, ".html") + "/" + suffix
+}
+
+// basePath returns the normalized BasePath, such as /docs,
+// or an empty string if the site is at the root.
+func (m *Moontpl) basePath() string {
+	p := strings.Trim(m.BasePath, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// siteBaseURL returns siteURL with the BasePath, without a trailing slash,
+// such as https://example.org/docs. This is where the links from
+// the root of the site start. If the path of siteURL already
+// ends with the BasePath, it's not added again.
+func (m *Moontpl) siteBaseURL(siteURL string) string {
+	siteURL = strings.TrimSuffix(siteURL, "/")
+	base := m.basePath()
+	if base == "" {
+		return siteURL
+	}
+	if u, err := url.Parse(siteURL); err == nil && strings.HasSuffix(u.Path, base) {
+		return siteURL
+	}
+	return siteURL + base
+}
+
+// stripBasePath removes the BasePath prefix from an absolute link.
+// Links that don't have the prefix are returned unchanged.
+func (m *Moontpl) stripBasePath(link string) string {
+	base := m.basePath()
+	if base == "" || !strings.HasPrefix(link, base) {
+		return link
+	}
+	rest := link[len(base):]
+	switch {
+	case rest == "":
+		return "/"
+	case rest[0] == '/':
+		return rest
+	case rest[0] == '?' || rest[0] == '#':
+		return "/" + rest
+	}
+	return link
+}
+
+// urlPath converts an absolute page link into the URL path
+// where it's served, with the BasePath and PrettyURLs applied.
+func (m *Moontpl) urlPath(link string) string {
+	return m.basePath() + m.outputLink(m.stripBasePath(link))
+}
+
+// pageLinkFromURL is the inverse of outputLink, it returns
+// the page link of a URL such as /about/.
+func (m *Moontpl) pageLinkFromURL(link string) string {
+	p, suffix := splitLink(link)
+	if !m.PrettyURLs || !strings.HasSuffix(p, "/") {
+		return link
+	}
+	index := p + "index.html"
+	if p == "/" || m.pageExists(index) {
+		return index + suffix
+	}
+	if page := strings.TrimSuffix(p, "/") + ".html"; m.pageExists(page) {
+		return page + suffix
+	}
+	return index + suffix
+}
+
+func (m *Moontpl) pageExists(link string) bool {
+	_, filename := extractPathParams(filepath.Join(m.SiteDir, link+".lua"))
+	return m.siteFileExists(filename)
+}
+
+// absoluteLink resolves a link that is relative to the page source.
+func absoluteLink(pageLink, link string) string {
+	if link == "" || link[0] == '/' {
+		return link
+	}
+	p, suffix := splitLink(link)
+	result := path.Join(path.Dir(pageLink), p)
+	if strings.HasSuffix(p, "/") && result != "/" {
+		result += "/"
+	}
+	return result + suffix
+}
+
+// relativeURL converts a link that is relative to the page source
+// into a link that is relative to where the page is served.
+func (m *Moontpl) relativeURL(pageLink, link string) string {
+	if !isLocalLink(link) {
+		return link
+	}
+	p, suffix := splitLink(m.outputLink(m.stripBasePath(absoluteLink(pageLink, link))))
+	result := relativeFrom(p, m.outputFile(pageLink))
+	if strings.HasSuffix(p, "/") && !strings.HasSuffix(result, "/") {
+		result += "/"
+	}
+	return result + suffix
+}
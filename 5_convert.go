@@ -0,0 +1,555 @@
+package moontpl
+
+import (
+	"cmp"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	luar "layeh.com/gopher-luar"
+)
+
+// ToLua converts a go value into a lua value. Unlike luar.New,
+// structs, maps, slices and arrays are deeply converted into tables,
+// so that they can be iterated with pairs and ipairs.
+//
+// Struct fields are named after the `luar` tag, or the field name if
+// there's no tag. Fields tagged with `luar:"-"` are skipped, and the
+// fields of embedded structs are included in the table.
+// A time.Time is converted to an RFC3339 string, a json.Marshaler to the
+// value of its JSON, and an encoding.TextMarshaler to a string.
+// Functions and channels are passed with luar.New, and lua values as is.
+//
+// An error is returned if the value contains itself.
+func ToLua(L *lua.LState, value any) (lua.LValue, error) {
+	c := &luaConverter{L: L, visiting: map[visitKey]bool{}}
+	return c.toLua(reflect.ValueOf(value), "")
+}
+
+// FromLua converts a lua value into a go value, which is one of
+// nil, bool, float64, string, []any, map[string]any, *lua.LFunction,
+// or the value of a userdata. A table is converted to a []any if its keys
+// are 1..n, otherwise to a map[string]any. An empty table is an empty map.
+//
+// An error is returned if a table contains itself,
+// or if a table key is not a string or a number.
+func FromLua(lv lua.LValue) (any, error) {
+	var result any
+	err := FromLuaInto(lv, &result)
+	return result, err
+}
+
+// FromLuaInto converts a lua value into the go value that target points to.
+// It's the reverse of ToLua: tables are converted into structs, maps and slices,
+// and strings into a time.Time or an encoding.TextUnmarshaler.
+// Struct fields are matched the same way as in ToLua.
+func FromLuaInto(lv lua.LValue, target any) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("cannot convert lua value into %T: target must be a non-nil pointer", target)
+	}
+	c := &luaConverter{visiting: map[visitKey]bool{}}
+	return c.fromLua(lv, rv.Elem(), "")
+}
+
+// ConversionError is returned by ToLua, FromLua and FromLuaInto.
+type ConversionError struct {
+	// Path is the location of the value, such as .posts[2].title.
+	// It's empty for the value itself.
+	Path    string
+	Message string
+}
+
+func (e *ConversionError) Error() string {
+	if e.Path == "" {
+		return "cannot convert value: " + e.Message
+	}
+	return "cannot convert value at " + e.Path + ": " + e.Message
+}
+
+func conversionError(path string, format string, args ...any) error {
+	return &ConversionError{Path: path, Message: fmt.Sprintf(format, args...)}
+}
+
+type luaConverter struct {
+	L        *lua.LState
+	visiting map[visitKey]bool
+}
+
+// visitKey identifies a pointer, map, slice or table that is being
+// converted, for detecting values that contain themselves.
+type visitKey struct {
+	ptr any
+	typ reflect.Type
+}
+
+var (
+	luaValueType        = reflect.TypeOf((*lua.LValue)(nil)).Elem()
+	timeType            = reflect.TypeOf(time.Time{})
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+func (c *luaConverter) toLua(rv reflect.Value, path string) (lua.LValue, error) {
+	if !rv.IsValid() {
+		return lua.LNil, nil
+	}
+
+	rt := rv.Type()
+	switch {
+	case rt.Implements(luaValueType):
+		if isNilValue(rv) {
+			return lua.LNil, nil
+		}
+		return rv.Interface().(lua.LValue), nil
+
+	case rt == timeType:
+		return lua.LString(rv.Interface().(time.Time).Format(time.RFC3339)), nil
+
+	case rt.Implements(jsonMarshalerType) && !isNilValue(rv):
+		data, err := rv.Interface().(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return lua.LNil, conversionError(path, "%v", err)
+		}
+		var value any
+		if err := json.Unmarshal(data, &value); err != nil {
+			return lua.LNil, conversionError(path, "%v", err)
+		}
+		return c.toLua(reflect.ValueOf(value), path)
+
+	case rt.Implements(textMarshalerType) && !isNilValue(rv):
+		text, err := rv.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return lua.LNil, conversionError(path, "%v", err)
+		}
+		return lua.LString(text), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return lua.LBool(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return lua.LNumber(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return lua.LNumber(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return lua.LNumber(rv.Float()), nil
+	case reflect.String:
+		return lua.LString(rv.String()), nil
+
+	case reflect.Interface:
+		if rv.IsNil() {
+			return lua.LNil, nil
+		}
+		return c.toLua(rv.Elem(), path)
+
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return lua.LNil, nil
+		}
+		if err := c.enter(valueVisitKey(rv), path); err != nil {
+			return lua.LNil, err
+		}
+		defer c.leave(valueVisitKey(rv))
+		return c.toLua(rv.Elem(), path)
+
+	case reflect.Slice:
+		if rt.Elem().Kind() == reflect.Uint8 {
+			return lua.LString(rv.Bytes()), nil
+		}
+		if rv.IsNil() {
+			return c.L.NewTable(), nil
+		}
+		if err := c.enter(valueVisitKey(rv), path); err != nil {
+			return lua.LNil, err
+		}
+		defer c.leave(valueVisitKey(rv))
+		fallthrough
+
+	case reflect.Array:
+		t := c.L.CreateTable(rv.Len(), 0)
+		for i := 0; i < rv.Len(); i++ {
+			lv, err := c.toLua(rv.Index(i), path+"["+strconv.Itoa(i+1)+"]")
+			if err != nil {
+				return lua.LNil, err
+			}
+			t.RawSetInt(i+1, lv)
+		}
+		return t, nil
+
+	case reflect.Map:
+		if rv.IsNil() {
+			return c.L.NewTable(), nil
+		}
+		if err := c.enter(valueVisitKey(rv), path); err != nil {
+			return lua.LNil, err
+		}
+		defer c.leave(valueVisitKey(rv))
+
+		// the keys are sorted so that the order of pairs() is the same for every run
+		keys := rv.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return cmp.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+		})
+
+		t := c.L.CreateTable(0, len(keys))
+		for _, k := range keys {
+			key, err := c.toLua(k, path)
+			if err != nil {
+				return lua.LNil, err
+			}
+			switch key.(type) {
+			case lua.LString, lua.LNumber, lua.LBool:
+			default:
+				return lua.LNil, conversionError(path, "unsupported map key type %s", k.Type())
+			}
+			val, err := c.toLua(rv.MapIndex(k), path+"."+fmt.Sprint(k.Interface()))
+			if err != nil {
+				return lua.LNil, err
+			}
+			t.RawSet(key, val)
+		}
+		return t, nil
+
+	case reflect.Struct:
+		t := c.L.NewTable()
+		err := eachStructField(rv, false, func(name string, fv reflect.Value) error {
+			lv, err := c.toLua(fv, path+"."+name)
+			if err != nil {
+				return err
+			}
+			t.RawSetString(name, lv)
+			return nil
+		})
+		if err != nil {
+			return lua.LNil, err
+		}
+		return t, nil
+
+	case reflect.Func, reflect.Chan:
+		return luar.New(c.L, rv.Interface()), nil
+	}
+
+	return lua.LNil, conversionError(path, "unsupported type %s", rt)
+}
+
+func (c *luaConverter) fromLua(lv lua.LValue, rv reflect.Value, path string) error {
+	rt := rv.Type()
+
+	if rt.Implements(luaValueType) && reflect.TypeOf(lv).AssignableTo(rt) {
+		rv.Set(reflect.ValueOf(lv))
+		return nil
+	}
+
+	if ud, ok := lv.(*lua.LUserData); ok {
+		if ud.Value != nil && reflect.TypeOf(ud.Value).AssignableTo(rt) {
+			rv.Set(reflect.ValueOf(ud.Value))
+			return nil
+		}
+		return conversionError(path, "cannot use userdata of %T as %s", ud.Value, rt)
+	}
+
+	switch {
+	case rt.Kind() == reflect.Pointer:
+		if lv == lua.LNil {
+			rv.SetZero()
+			return nil
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.New(rt.Elem()))
+		}
+		return c.fromLua(lv, rv.Elem(), path)
+
+	case rt.Kind() == reflect.Interface && rt.NumMethod() == 0:
+		value, err := c.fromLuaAny(lv, path)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			rv.SetZero()
+		} else {
+			rv.Set(reflect.ValueOf(value))
+		}
+		return nil
+
+	case lv == lua.LNil:
+		rv.SetZero()
+		return nil
+
+	case rt == timeType:
+		s, ok := lv.(lua.LString)
+		if !ok {
+			return conversionError(path, "cannot use lua %s as %s", lv.Type(), rt)
+		}
+		t, err := time.Parse(time.RFC3339, string(s))
+		if err != nil {
+			return conversionError(path, "%v", err)
+		}
+		rv.Set(reflect.ValueOf(t))
+		return nil
+
+	case reflect.PointerTo(rt).Implements(jsonUnmarshalerType):
+		value, err := c.fromLuaAny(lv, path)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(value)
+		if err == nil {
+			err = rv.Addr().Interface().(json.Unmarshaler).UnmarshalJSON(data)
+		}
+		if err != nil {
+			return conversionError(path, "%v", err)
+		}
+		return nil
+
+	case reflect.PointerTo(rt).Implements(textUnmarshalerType) && lv.Type() == lua.LTString:
+		if err := rv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(lv.String())); err != nil {
+			return conversionError(path, "%v", err)
+		}
+		return nil
+
+	}
+
+	mismatch := func() error {
+		return conversionError(path, "cannot use lua %s as %s", lv.Type(), rt)
+	}
+
+	switch rt.Kind() {
+	case reflect.Bool:
+		b, ok := lv.(lua.LBool)
+		if !ok {
+			return mismatch()
+		}
+		rv.SetBool(bool(b))
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := lv.(lua.LNumber)
+		if !ok || float64(n) != math.Trunc(float64(n)) || rv.OverflowInt(int64(n)) {
+			return mismatch()
+		}
+		rv.SetInt(int64(n))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := lv.(lua.LNumber)
+		if !ok || n < 0 || float64(n) != math.Trunc(float64(n)) || rv.OverflowUint(uint64(n)) {
+			return mismatch()
+		}
+		rv.SetUint(uint64(n))
+
+	case reflect.Float32, reflect.Float64:
+		n, ok := lv.(lua.LNumber)
+		if !ok {
+			return mismatch()
+		}
+		rv.SetFloat(float64(n))
+
+	case reflect.String:
+		switch v := lv.(type) {
+		case lua.LString, lua.LNumber:
+			rv.SetString(v.String())
+		default:
+			return mismatch()
+		}
+
+	case reflect.Slice, reflect.Array:
+		if s, ok := lv.(lua.LString); ok && rt.Kind() == reflect.Slice && rt.Elem().Kind() == reflect.Uint8 {
+			rv.SetBytes([]byte(s))
+			return nil
+		}
+		t, ok := lv.(*lua.LTable)
+		if !ok {
+			return mismatch()
+		}
+		if err := c.enter(visitKey{ptr: t}, path); err != nil {
+			return err
+		}
+		defer c.leave(visitKey{ptr: t})
+
+		n := t.Len()
+		if rt.Kind() == reflect.Slice {
+			rv.Set(reflect.MakeSlice(rt, n, n))
+		} else if n > rt.Len() {
+			return conversionError(path, "cannot use a table of %d items as %s", n, rt)
+		}
+		for i := 0; i < n; i++ {
+			if err := c.fromLua(t.RawGetInt(i+1), rv.Index(i), path+"["+strconv.Itoa(i+1)+"]"); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		t, ok := lv.(*lua.LTable)
+		if !ok {
+			return mismatch()
+		}
+		if err := c.enter(visitKey{ptr: t}, path); err != nil {
+			return err
+		}
+		defer c.leave(visitKey{ptr: t})
+
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rt))
+		}
+		for k, v := t.Next(lua.LNil); k != lua.LNil; k, v = t.Next(k) {
+			key := reflect.New(rt.Key()).Elem()
+			if err := c.fromLua(k, key, path); err != nil {
+				return err
+			}
+			val := reflect.New(rt.Elem()).Elem()
+			if err := c.fromLua(v, val, path+"."+k.String()); err != nil {
+				return err
+			}
+			rv.SetMapIndex(key, val)
+		}
+
+	case reflect.Struct:
+		t, ok := lv.(*lua.LTable)
+		if !ok {
+			return mismatch()
+		}
+		if err := c.enter(visitKey{ptr: t}, path); err != nil {
+			return err
+		}
+		defer c.leave(visitKey{ptr: t})
+
+		return eachStructField(rv, true, func(name string, fv reflect.Value) error {
+			return c.fromLua(t.RawGetString(name), fv, path+"."+name)
+		})
+
+	default:
+		return mismatch()
+	}
+
+	return nil
+}
+
+// fromLuaAny converts the lua value into a go value, see FromLua.
+func (c *luaConverter) fromLuaAny(lv lua.LValue, path string) (any, error) {
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LFunction:
+		return v, nil
+	case *lua.LUserData:
+		return v.Value, nil
+
+	case *lua.LTable:
+		if err := c.enter(visitKey{ptr: v}, path); err != nil {
+			return nil, err
+		}
+		defer c.leave(visitKey{ptr: v})
+
+		if n := v.Len(); n > 0 && countTableKeys(v) == n {
+			result := make([]any, n)
+			for i := 1; i <= n; i++ {
+				item, err := c.fromLuaAny(v.RawGetInt(i), path+"["+strconv.Itoa(i)+"]")
+				if err != nil {
+					return nil, err
+				}
+				result[i-1] = item
+			}
+			return result, nil
+		}
+
+		result := map[string]any{}
+		for key, val := v.Next(lua.LNil); key != lua.LNil; key, val = v.Next(key) {
+			switch key.(type) {
+			case lua.LString, lua.LNumber:
+			default:
+				return nil, conversionError(path, "unsupported table key type %s", key.Type())
+			}
+			item, err := c.fromLuaAny(val, path+"."+key.String())
+			if err != nil {
+				return nil, err
+			}
+			result[key.String()] = item
+		}
+		return result, nil
+	}
+
+	return nil, conversionError(path, "unsupported lua type %s", lv.Type())
+}
+
+// eachStructField calls fn with the lua name and the value of the exported
+// fields of the struct, including the fields of embedded structs.
+// If alloc is true, nil embedded struct pointers are allocated.
+func eachStructField(rv reflect.Value, alloc bool, fn func(name string, fv reflect.Value) error) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		tag := field.Tag.Get("luar")
+		if tag == "-" {
+			continue
+		}
+
+		fv := rv.Field(i)
+		if field.Anonymous && tag == "" {
+			if fv.Kind() == reflect.Pointer && fv.Type().Elem().Kind() == reflect.Struct {
+				if fv.IsNil() {
+					if !alloc || !fv.CanSet() {
+						continue
+					}
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				if err := eachStructField(fv, alloc, fn); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if tag != "" {
+			name = tag
+		}
+		if err := fn(name, fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *luaConverter) enter(key visitKey, path string) error {
+	if c.visiting[key] {
+		return conversionError(path, "the value contains itself")
+	}
+	c.visiting[key] = true
+	return nil
+}
+
+func (c *luaConverter) leave(key visitKey) {
+	delete(c.visiting, key)
+}
+
+func valueVisitKey(rv reflect.Value) visitKey {
+	return visitKey{ptr: rv.Pointer(), typ: rv.Type()}
+}
+
+func isNilValue(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return rv.IsNil()
+	}
+	return false
+}
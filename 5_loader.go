@@ -11,10 +11,17 @@ import (
 
 type Loader struct {
 	fsys fs.FS
+
+	// resolve maps the filenames from package.path to the paths in fsys.
+	// If nil, the filenames are used as they are.
+	resolve func(filename string) (string, bool)
 }
 
 func initFsLoader(L *lua.LState, fsys fs.FS) {
-	loader := &Loader{fsys}
+	addLoader(L, &Loader{fsys: fsys})
+}
+
+func addLoader(L *lua.LState, loader *Loader) {
 	pkg := L.GetField(L.Get(lua.EnvironIndex), "package").(*lua.LTable)
 	loaders := L.GetField(pkg, "loaders").(*lua.LTable)
 	loaders.Append(L.NewFunction(loader.LoadFile))
@@ -22,7 +29,7 @@ func initFsLoader(L *lua.LState, fsys fs.FS) {
 
 func (l *Loader) LoadFile(L *lua.LState) int {
 	name := L.CheckString(1)
-	path, msg := l.loFindFile(L, name, "path")
+	path, filename, msg := l.loFindFile(L, name, "path")
 	if len(path) == 0 {
 		L.Push(lua.LString(msg))
 		return 1
@@ -34,7 +41,7 @@ func (l *Loader) LoadFile(L *lua.LState) int {
 		return 1
 	}
 
-	fn, err1 := L.LoadString(string(bytes))
+	fn, err1 := L.Load(strings.NewReader(string(bytes)), filename)
 	if err1 != nil {
 		L.RaiseError("failed to loadfile from fs.FS: %v", err1.Error())
 	}
@@ -42,7 +49,7 @@ func (l *Loader) LoadFile(L *lua.LState) int {
 	return 1
 }
 
-func (l *Loader) loFindFile(L *lua.LState, name, pname string) (string, string) {
+func (l *Loader) loFindFile(L *lua.LState, name, pname string) (string, string, string) {
 	name = strings.Replace(name, ".", string(os.PathSeparator), -1)
 	lv := L.GetField(L.GetField(L.Get(lua.EnvironIndex), "package"), pname)
 	lpath, ok := lv.(lua.LString)
@@ -51,12 +58,19 @@ func (l *Loader) loFindFile(L *lua.LState, name, pname string) (string, string)
 	}
 	messages := []string{}
 	for _, pattern := range strings.Split(string(lpath), ";") {
-		luapath := path.Clean(strings.Replace(pattern, "?", name, -1))
+		filename := path.Clean(strings.Replace(pattern, "?", name, -1))
+		luapath := filename
+		if l.resolve != nil {
+			var ok bool
+			if luapath, ok = l.resolve(filename); !ok {
+				continue
+			}
+		}
 		if _, err := fs.Stat(l.fsys, luapath); err == nil {
-			return luapath, ""
+			return luapath, filename, ""
 		} else if !os.IsNotExist(err) {
 			messages = append(messages, err.Error())
 		}
 	}
-	return "", strings.Join(messages, "\n\t")
+	return "", "", strings.Join(messages, "\n\t")
 }
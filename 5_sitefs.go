@@ -0,0 +1,309 @@
+package moontpl
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// The site files are still named by their path in SiteDir,
+// such as /site/index.html.lua, but they are read from siteFS.
+// Files outside of SiteDir, like the lua modules in other
+// directories, are read from the os filesystem.
+
+// AddTheme adds a theme directory under the site. The files in the site
+// override the theme files of the same path, and the themes added later
+// override the ones added before.
+func (m *Moontpl) AddTheme(dir string) {
+	m.themeDirs = append(m.themeDirs, mustAbs(dir))
+}
+
+// siteFS returns the filesystem of the site,
+// with the site over the theme layers.
+func (m *Moontpl) siteFS() fs.FS {
+	var site fs.FS = os.DirFS(mustAbs(m.SiteDir))
+	if m.SiteFS != nil {
+		site = m.SiteFS
+	}
+	if len(m.themeDirs) > 0 {
+		layers := make(layeredFS, 0, len(m.themeDirs)+1)
+		for _, dir := range m.themeDirs {
+			layers = append(layers, os.DirFS(dir))
+		}
+		site = append(layers, site)
+	}
+	if len(m.ignorePatterns) > 0 {
+		site = ignoreFS{site, m.ignorePatterns}
+	}
+	return site
+}
+
+// isVirtualSite returns true if the site files are not
+// simply the files in SiteDir.
+func (m *Moontpl) isVirtualSite() bool {
+	return m.SiteFS != nil || len(m.themeDirs) > 0 || len(m.ignorePatterns) > 0
+}
+
+// fileLayer returns the directory of the layer that the file
+// at p in siteFS comes from, either SiteDir or a theme directory.
+func (m *Moontpl) fileLayer(p string) string {
+	fsys := m.siteFS()
+	if f, ok := fsys.(ignoreFS); ok {
+		fsys = f.fsys
+	}
+	if layers, ok := fsys.(layeredFS); ok {
+		if i := layers.layerOf(p); i < len(m.themeDirs) && i >= 0 {
+			return m.themeDirs[i]
+		}
+	}
+	return mustAbs(m.SiteDir)
+}
+
+// layerDirOf returns the site or theme directory
+// that contains the file in the os filesystem.
+func (m *Moontpl) layerDirOf(filename string) (string, bool) {
+	for _, dir := range append([]string{mustAbs(m.SiteDir)}, m.themeDirs...) {
+		if isSubDirectory(dir, filename) {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// sitePath returns the path in siteFS of a file in SiteDir.
+func (m *Moontpl) sitePath(filename string) (string, bool) {
+	rel, err := filepath.Rel(mustAbs(m.SiteDir), mustAbs(filename))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func (m *Moontpl) openSiteFile(filename string) (fs.File, error) {
+	if !m.isVirtualSite() {
+		return os.Open(filename)
+	}
+	p, ok := m.sitePath(filename)
+	if !ok {
+		return os.Open(filename)
+	}
+	file, err := m.siteFS().Open(p)
+	if err != nil {
+		// show the site filename instead of the path in SiteFS
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			pathErr.Path = filename
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func (m *Moontpl) readSiteFile(filename string) ([]byte, error) {
+	file, err := m.openSiteFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// statSiteFile is like fsStat, a missing file is not an error.
+func (m *Moontpl) statSiteFile(filename string) (fs.FileInfo, error) {
+	file, err := m.openSiteFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+func (m *Moontpl) siteFileExists(filename string) bool {
+	stat, err := m.statSiteFile(filename)
+	return err == nil && stat != nil
+}
+
+// walkSiteDir walks the files in dir, which is usually SiteDir.
+// The filenames passed to fn are joined with dir.
+func (m *Moontpl) walkSiteDir(dir string, fn func(filename string, d fs.DirEntry) error) error {
+	fsys, root := fs.FS(os.DirFS(dir)), "."
+	if p, ok := m.sitePath(dir); ok {
+		fsys, root = m.siteFS(), p
+	}
+	return fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		var rel string
+		if root == "." {
+			rel = p
+		} else if p != root {
+			rel = strings.TrimPrefix(p, root+"/")
+		}
+		return fn(filepath.Join(dir, filepath.FromSlash(rel)), d)
+	})
+}
+
+// loadSiteFile loads the lua file without running it.
+func (m *Moontpl) loadSiteFile(L *lua.LState, filename string) (*lua.LFunction, error) {
+	file, err := m.openSiteFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return L.Load(file, filename)
+}
+
+// doSiteFile runs the lua file, like L.DoFile.
+func (m *Moontpl) doSiteFile(L *lua.LState, filename string) error {
+	fn, err := m.loadSiteFile(L, filename)
+	if err != nil {
+		return err
+	}
+	L.Push(fn)
+	return L.PCall(0, lua.MultRet, nil)
+}
+
+// copySiteFile copies a file of the site into the output directory.
+func (m *Moontpl) copySiteFile(src, dest string) error {
+	inputFile, err := m.openSiteFile(src)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+
+	outputFile, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	if _, err = io.Copy(outputFile, inputFile); err != nil {
+		return err
+	}
+	return outputFile.Close()
+}
+
+// layeredFS overlays filesystems, the files in the later layers
+// hide the files of the same path in the earlier layers.
+// The directories are merged.
+type layeredFS []fs.FS
+
+func (l layeredFS) Open(name string) (fs.File, error) {
+	var firstErr error
+	for i := len(l) - 1; i >= 0; i-- {
+		file, err := l[i].Open(name)
+		if err == nil {
+			return file, nil
+		}
+		// a missing file is only reported if no layer has it
+		if firstErr == nil || (errors.Is(firstErr, fs.ErrNotExist) && !errors.Is(err, fs.ErrNotExist)) {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (l layeredFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries := map[string]fs.DirEntry{}
+	var firstErr error
+	found := false
+	for _, layer := range l {
+		list, err := fs.ReadDir(layer, name)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		found = true
+		for _, entry := range list {
+			entries[entry.Name()] = entry
+		}
+	}
+	if !found {
+		return nil, firstErr
+	}
+
+	result := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, nil
+}
+
+// layerOf returns the index of the layer that has the file, or -1.
+func (l layeredFS) layerOf(name string) int {
+	for i := len(l) - 1; i >= 0; i-- {
+		if _, err := fs.Stat(l[i], name); err == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// ignoreFS hides the files that match the ignore patterns.
+type ignoreFS struct {
+	fsys     fs.FS
+	patterns []string
+}
+
+func (f ignoreFS) Open(name string) (fs.File, error) {
+	if isIgnored(f.patterns, name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.fsys.Open(name)
+}
+
+func (f ignoreFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if isIgnored(f.patterns, name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	result := entries[:0]
+	for _, entry := range entries {
+		if !isIgnored(f.patterns, path.Join(name, entry.Name())) {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+// isIgnored returns true if the file or one of its parent
+// directories matches a pattern, see Config.Ignore.
+func isIgnored(patterns []string, name string) bool {
+	if name == "." {
+		return false
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		sub := strings.Join(parts[:i+1], "/")
+		for _, pattern := range patterns {
+			target := sub
+			if !strings.Contains(pattern, "/") {
+				target = part
+			}
+			pattern = strings.TrimPrefix(pattern, "/")
+			if ok, _ := path.Match(pattern, target); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
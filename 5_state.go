@@ -1,10 +1,14 @@
 package moontpl
 
 import (
+	"fmt"
 	"io/fs"
-	"os"
+	"net/http"
 	"path"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/laher/mergefs"
 	lua "github.com/yuin/gopher-lua"
@@ -13,6 +17,10 @@ import (
 
 const filenameRegistryIndex = lua.LNumber(-9988001)
 
+// generatedLinksRegistryIndex contains the relative links returned
+// by the path module, which must not be rewritten again by path.url.
+const generatedLinksRegistryIndex = lua.LNumber(-9988004)
+
 const (
 	CommandNone = iota
 	CommandRun
@@ -21,20 +29,66 @@ const (
 )
 
 type Moontpl struct {
-	SiteDir    string
+	SiteDir string
+
+	// SiteFS is the filesystem the site is read from, such as an embed.FS.
+	// If nil, the files in SiteDir are used. The pages are still named
+	// by their path in SiteDir, so SiteDir can be any absolute path,
+	// like /site, that is used in the page filenames and error messages.
+	SiteFS fs.FS
+
+	// SiteURL is the URL where the site is deployed, such as https://example.org.
+	// This is used for generating absolute URLs, as in the sitemap.
+	// The BasePath is added to it, unless it already ends with the BasePath.
+	SiteURL string
+
+	// PrettyURLs makes pages served and built as directories,
+	// such that /about.html.lua is at /about/ (written to about/index.html).
+	PrettyURLs bool
+
+	// BasePath is the URL path where the site is deployed, such as /docs
+	// for https://example.org/docs/. Root-relative links are prefixed with it.
+	BasePath string
+
+	// RenderTimeout is the time limit for rendering a single page
+	// when serving or building the site. Zero means no limit.
+	RenderTimeout time.Duration
+
+	// SiteData is the site-wide metadata, such as the title
+	// and the author, available in lua as require("site").data.
+	SiteData map[string]any
+
 	Command    int
 	luaModules map[string]ModMap
 	luaGlobals map[string]any
 	runtags    map[string]struct{}
 
+	// luaPath is the package.path of the lua states,
+	// separate from the other instances.
+	luaPath string
+
 	fileSystems []fs.FS
 	fsys        fs.FS
+	themeDirs   []string
+
+	// ignorePatterns hide the matching site files, see Config.Ignore
+	ignorePatterns []string
 
 	builder   *siteBuilder
 	fsWatcher *FsWatcher
 
+	server   *http.Server
+	serverMu sync.Mutex
+	// serverStarting is set from the start of Serve until the
+	// server is stored, and shutdownRequested is set by a Shutdown
+	// called in between, so that Serve stops right away
+	serverStarting    bool
+	shutdownRequested bool
+
 	luaPool        *lStatePool
 	disableLuaPool bool
+
+	outputProcessors map[string]OutputProcessor
 }
 
 type PageData map[string]any
@@ -55,8 +109,12 @@ func New() *Moontpl {
 		luaPool: &lStatePool{
 			saved: make([]*lua.LState, 0, 4),
 		},
+
+		outputProcessors: map[string]OutputProcessor{},
 	}
 
+	self.registerDefaultOutputProcessors()
+
 	self.AddFs(embedded)
 	self.AddLuaPath("./lua/?.lua")
 
@@ -74,16 +132,33 @@ func (m *Moontpl) AddFs(fsys fs.FS) {
 	m.fsys = mergefs.Merge(m.fileSystems...)
 }
 
-func (m *Moontpl) SetGlobal(varname string, obj any) {
+// SetGlobal adds a global variable to the lua states.
+// An error is returned if obj can't be converted into a lua value,
+// such as a map that contains itself, and the global is not added.
+func (m *Moontpl) SetGlobal(varname string, obj any) error {
+	if err := checkAddedValue(obj); err != nil {
+		return fmt.Errorf("global %s: %w", varname, err)
+	}
 	m.luaGlobals[varname] = obj
+	return nil
 }
-func (m *Moontpl) SetModule(moduleName string, modMap ModMap) {
+
+// SetModule adds a module that can be loaded with require(moduleName).
+// An error is returned if a value of modMap can't be converted into
+// a lua value, and the module is not added.
+func (m *Moontpl) SetModule(moduleName string, modMap ModMap) error {
+	for varname, val := range modMap {
+		if err := checkAddedValue(val); err != nil {
+			return fmt.Errorf("%s.%s: %w", moduleName, varname, err)
+		}
+	}
 	m.luaModules[moduleName] = modMap
+	return nil
 }
 
 func (m *Moontpl) AddLuaPath(pathStr string) {
 	var sep string
-	var path = strings.TrimSpace(lua.LuaPathDefault)
+	var path = strings.TrimSpace(m.luaPath)
 
 	if len(path) > 0 {
 		if path[len(path)-1] == ';' {
@@ -93,7 +168,7 @@ func (m *Moontpl) AddLuaPath(pathStr string) {
 		}
 	}
 
-	lua.LuaPathDefault = path + sep + pathStr
+	m.luaPath = path + sep + pathStr
 }
 
 func (m *Moontpl) AddLuaDir(dir string) {
@@ -103,8 +178,7 @@ func (m *Moontpl) AddLuaDir(dir string) {
 func (m *Moontpl) SetPageData(L *lua.LState, pageData PageData) {
 	mod := getLoadedModule(L, "page")
 	if mod != lua.LNil {
-		t := pageDataToLValue(L, pageData)
-		L.SetField(mod, "input", t)
+		L.SetField(mod, "input", mustToLua(L, map[string]any(pageData)))
 	}
 }
 
@@ -129,7 +203,21 @@ func (m *Moontpl) getState(filename string) *lua.LState {
 		L = m.createState()
 	}
 
+	m.resetPageState(L, filename)
+
+	return L
+}
+
+// resetPageState prepares a (possibly reused) lua state
+// for rendering the given page.
+func (m *Moontpl) resetPageState(L *lua.LState, filename string) {
+	L.SetTop(0)
 	L.G.Registry.RawSet(filenameRegistryIndex, lua.LString(filename))
+	L.G.Registry.RawSet(generatedLinksRegistryIndex, L.NewTable())
+
+	if dt := getDependencyTracker(L); dt != nil {
+		dt.ResetUsed()
+	}
 
 	L.DoString(`return require("page")`)
 	page := L.Get(-1)
@@ -141,8 +229,6 @@ func (m *Moontpl) getState(filename string) *lua.LState {
 		L.SetField(page, "input", L.NewTable())
 		L.SetField(page, "onRender", lua.LNil)
 	}
-
-	return L
 }
 
 func (m *Moontpl) putState(L *lua.LState) {
@@ -163,18 +249,27 @@ func (m *Moontpl) createState(initModules ...bool /* = true */) *lua.LState {
 	m.openLibs(L)
 	m.patchStdLib(L)
 
+	// use the lua path of this instance instead of LUA_PATH
+	pkg := L.GetField(L.Get(lua.EnvironIndex), "package")
+	L.SetField(pkg, "path", lua.LString(m.luaPath))
+
 	if len(initModules) == 0 || initModules[0] {
 		m.initAddedGlobals(L)
 		m.initAddedModules(L)
+		m.initHTMLModule(L)
 		m.initPageModule(L)
 		m.initPathModule(L)
 		m.initBuildModule(L)
 		m.initTagsModule(L)
 		m.initSiteModule(L)
+		m.initFeedModule(L)
 	}
 
 	// allow loading lua modules from fs.Fs (mainly for embedded files)
-	initFsLoader(L, moontpl.fsys)
+	initFsLoader(L, m.fsys)
+	if m.isVirtualSite() {
+		addLoader(L, &Loader{fsys: m.siteFS(), resolve: m.sitePath})
+	}
 
 	return L
 }
@@ -227,9 +322,9 @@ func (m *Moontpl) patchStdLib(L *lua.LState) {
 	// will also be reloaded. Lua state pooling must also
 	// be enabled, otherwise, there's no point to tracking
 	// dependencies because modules will be always loaded
-	// for every render.
+	// for every render. dofile and loadfile also read the files
+	// from SiteFS instead of the os filesystem.
 
-	dofile := L.GetGlobal("dofile").(*lua.LFunction)
 	L.SetGlobal("dofile", L.NewFunction(dt.wrap(m, func(L *lua.LState) int {
 		src := L.ToString(1)
 		src = path.Join(m.SiteDir, src)
@@ -238,27 +333,33 @@ func (m *Moontpl) patchStdLib(L *lua.LState) {
 			src += ".lua"
 		}
 
+		fn, err := m.loadSiteFile(L, src)
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+
 		top := L.GetTop()
-		L.Push(dofile)
-		L.Push(lua.LString(src))
-		L.Call(1, lua.MultRet)
+		L.Push(fn)
+		L.Call(0, lua.MultRet)
 
 		return L.GetTop() - top
 	})))
 
-	loadfile := L.GetGlobal("loadfile").(*lua.LFunction)
 	L.SetGlobal("loadfile", L.NewFunction(dt.wrap(m, func(L *lua.LState) int {
 		src := path.Join(m.SiteDir, L.ToString(1))
 		if !strings.HasSuffix(src, ".lua") {
 			src += ".lua"
 		}
 
-		top := L.GetTop()
-		L.Push(loadfile)
-		L.Push(lua.LString(src))
-		L.Call(1, lua.MultRet)
+		fn, err := m.loadSiteFile(L, src)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
 
-		return L.GetTop() - top
+		L.Push(fn)
+		return 1
 	})))
 
 	require := L.GetGlobal("require").(*lua.LFunction)
@@ -276,7 +377,13 @@ func (m *Moontpl) patchStdLib(L *lua.LState) {
 
 func (m *Moontpl) initAddedGlobals(L *lua.LState) {
 	for varname, v := range m.luaGlobals {
-		L.SetGlobal(varname, luar.New(L, v))
+		lv, err := addedValueToLua(L, v)
+		if err != nil {
+			// SetGlobal already checked the value, so it was
+			// changed afterwards to something that can't be converted
+			panic(fmt.Errorf("global %s: %w", varname, err))
+		}
+		L.SetGlobal(varname, lv)
 	}
 }
 
@@ -286,7 +393,11 @@ func (m *Moontpl) initAddedModules(L *lua.LState) {
 			mod := L.NewTable()
 
 			for varname, val := range modMap {
-				L.SetField(mod, varname, luar.New(L, val))
+				lv, err := addedValueToLua(L, val)
+				if err != nil {
+					L.RaiseError("%s.%s: %s", moduleName, varname, err.Error())
+				}
+				L.SetField(mod, varname, lv)
 			}
 
 			L.Push(mod)
@@ -300,7 +411,7 @@ func (m *Moontpl) initPathModule(L *lua.LState) {
 		mod := m.loadDefaultTableModule(L, "path")
 		L.SetField(mod, "getParams", L.NewFunction(func(L *lua.LState) int {
 			link := L.CheckString(1)
-			L.Push(mapToLtable(L, getPathParams(link)))
+			L.Push(mustToLua(L, getPathParams(link)))
 			return 1
 		}))
 
@@ -323,11 +434,34 @@ func (m *Moontpl) initPathModule(L *lua.LState) {
 			return 1
 		}))
 
-		L.SetField(mod, "relative", L.NewFunction(func(L *lua.LState) int {
-			targetLink := L.CheckString(1)
+		L.SetField(mod, "PRETTY_URLS", lua.LBool(m.PrettyURLs))
+		L.SetField(mod, "BASE_PATH", lua.LString(m.basePath()))
 
+		getPageLink := func(L *lua.LState) string {
 			filename := string(L.G.Registry.RawGet(filenameRegistryIndex).(lua.LString))
-			L.Push(lua.LString(relativeFrom(targetLink, m.getPagePath(filename).Link)))
+			return m.getPagePath(filename).Link
+		}
+		generatedLinks := func(L *lua.LState) *lua.LTable {
+			t, ok := L.G.Registry.RawGet(generatedLinksRegistryIndex).(*lua.LTable)
+			if !ok {
+				t = L.NewTable()
+				L.G.Registry.RawSet(generatedLinksRegistryIndex, t)
+			}
+			return t
+		}
+		relativeURL := func(L *lua.LState, link string) string {
+			result := m.relativeURL(getPageLink(L), link)
+			generatedLinks(L).RawSetString(result, lua.LTrue)
+			return result
+		}
+
+		L.SetField(mod, "relative", L.NewFunction(func(L *lua.LState) int {
+			targetLink := L.CheckString(1)
+			if m.PrettyURLs {
+				L.Push(lua.LString(relativeURL(L, targetLink)))
+			} else {
+				L.Push(lua.LString(relativeFrom(m.stripBasePath(targetLink), getPageLink(L))))
+			}
 			return 1
 		}))
 
@@ -338,19 +472,31 @@ func (m *Moontpl) initPathModule(L *lua.LState) {
 				return 1
 			}
 
-			if link[0] == '/' {
-				L.Push(lua.LString(link))
-				return 1
-			}
+			L.Push(lua.LString(m.urlPath(absoluteLink(getPageLink(L), link))))
+			return 1
+		}))
 
-			filename := string(L.G.Registry.RawGet(filenameRegistryIndex).(lua.LString))
-			pagePath := m.getPagePath(filename)
+		L.SetField(mod, "asset", L.NewFunction(func(L *lua.LState) int {
+			link := m.stripBasePath(absoluteLink(getPageLink(L), L.CheckString(1)))
+			p, suffix := splitLink(link)
 
-			result := path.Dir(pagePath.Link)
-			result = path.Join(result, link)
-			result = path.Clean(result)
+			trackDependency(L, assetsDependency)
+			L.Push(lua.LString(m.urlPath(m.assetLink(p) + suffix)))
+			return 1
+		}))
 
-			L.Push(lua.LString(result))
+		L.SetField(mod, "url", L.NewFunction(func(L *lua.LState) int {
+			link := L.CheckString(1)
+			switch {
+			case !isLocalLink(link):
+				L.Push(lua.LString(link))
+			case link[0] == '/':
+				L.Push(lua.LString(m.urlPath(link)))
+			case m.PrettyURLs && generatedLinks(L).RawGetString(link) == lua.LNil:
+				L.Push(lua.LString(relativeURL(L, link)))
+			default:
+				L.Push(lua.LString(link))
+			}
 			return 1
 		}))
 
@@ -372,6 +518,8 @@ func (m *Moontpl) initPageModule(L *lua.LState) {
 		L.SetField(mod, "PAGE_LINK", lua.LString(pagePath.Link))
 
 		L.SetField(mod, "files", L.NewFunction(func(L *lua.LState) int {
+			trackDependency(L, filesDependency)
+
 			paths, err := m.GetPageFilenames(m.SiteDir)
 			if err != nil {
 				panic(err)
@@ -382,18 +530,19 @@ func (m *Moontpl) initPageModule(L *lua.LState) {
 				filenames = append(filenames, p.Link)
 			}
 
-			L.Push(arrayToLTable(L, filenames))
+			L.Push(mustToLua(L, filenames))
 			return 1
 		}))
 
 		L.SetField(mod, "list", L.NewFunction(func(L *lua.LState) int {
+			trackDependency(L, pagesDependency)
+
 			pages, err := m.GetPages()
 			if err != nil {
 				panic(err)
 			}
 
-			lv := arrayToLTable(L, pages)
-			L.Push(lv)
+			L.Push(mustToLua(L, pages))
 
 			return 1
 		}))
@@ -403,10 +552,29 @@ func (m *Moontpl) initPageModule(L *lua.LState) {
 	})
 }
 
+func (m *Moontpl) initHTMLModule(L *lua.LState) {
+	L.PreloadModule("html", func(L *lua.LState) int {
+		mod := m.loadDefaultTableModule(L, "html")
+		L.SetField(mod, "nodeToString", L.NewFunction(func(L *lua.LState) int {
+			var buf strings.Builder
+			if err := writeHTMLNode(L, &buf, L.Get(1)); err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			L.Push(lua.LString(buf.String()))
+			return 1
+		}))
+		L.Push(mod)
+		return 1
+	})
+}
+
 func (m *Moontpl) initBuildModule(L *lua.LState) {
 	L.PreloadModule("build", func(L *lua.LState) int {
 		mod := m.loadDefaultTableModule(L, "build")
-		L.SetField(mod, "queue", luar.New(L, m.queueLink))
+		L.SetField(mod, "queue", L.NewFunction(func(L *lua.LState) int {
+			m.queueLink(L, L.CheckString(1))
+			return 0
+		}))
 		L.Push(mod)
 		return 1
 	})
@@ -428,6 +596,8 @@ func (m *Moontpl) initSiteModule(L *lua.LState) {
 	L.PreloadModule("site", func(L *lua.LState) int {
 		mod := m.loadDefaultTableModule(L, "site")
 		L.SetField(mod, "files", L.NewFunction(func(L *lua.LState) int {
+			trackDependency(L, filesDependency)
+
 			options := L.OptTable(1, L.NewTable())
 
 			dir := lua.LString("/")
@@ -447,7 +617,8 @@ func (m *Moontpl) initSiteModule(L *lua.LState) {
 			}
 
 			result := L.NewTable()
-			err := fs.WalkDir(os.DirFS(m.SiteDir), ".", func(p string, entry fs.DirEntry, err error) error {
+			layers := L.NewTable()
+			err := fs.WalkDir(m.siteFS(), ".", func(p string, entry fs.DirEntry, err error) error {
 				if err != nil {
 					return err
 				}
@@ -455,6 +626,7 @@ func (m *Moontpl) initSiteModule(L *lua.LState) {
 					return nil
 				}
 
+				layer := m.fileLayer(p)
 				p = "/" + p
 				if !isSubDirectory(string(dir), p) {
 					return nil
@@ -487,6 +659,7 @@ func (m *Moontpl) initSiteModule(L *lua.LState) {
 				}
 
 				result.Append(lua.LString(p))
+				layers.RawSetString(p, lua.LString(layer))
 
 				return nil
 			})
@@ -496,109 +669,81 @@ func (m *Moontpl) initSiteModule(L *lua.LState) {
 			}
 
 			L.Push(result)
-			return 1
+			L.Push(layers)
+			return 2
 		}))
 
+		L.SetField(mod, "data", mustToLua(L, m.SiteData))
+
 		L.Push(mod)
 		return 1
 	})
 }
 
-func mapToLtable[T any](L *lua.LState, items map[string]T) lua.LValue {
-	t := L.NewTable()
-	for k, v := range items {
-		var lv lua.LValue
-		var x any = v
-		switch v := x.(type) {
-		case float32:
-			lv = lua.LNumber(v)
-		case float64:
-			lv = lua.LNumber(v)
-		case int:
-			lv = lua.LNumber(v)
-		case int8:
-			lv = lua.LNumber(v)
-		case int16:
-			lv = lua.LNumber(v)
-		case int32:
-			lv = lua.LNumber(v)
-		case int64:
-			lv = lua.LNumber(v)
-
-		case string:
-			lv = lua.LString(v)
-		case bool:
-			lv = lua.LBool(v)
-		default:
-			lv = luar.New(L, v)
+func (m *Moontpl) initFeedModule(L *lua.LState) {
+	L.PreloadModule("feed", func(L *lua.LState) int {
+		mod := m.loadDefaultTableModule(L, "feed")
+
+		generate := func(format func(*feed) ([]byte, error)) lua.LGFunction {
+			return func(L *lua.LState) int {
+				options := L.CheckTable(1)
+
+				filename := string(L.G.Registry.RawGet(filenameRegistryIndex).(lua.LString))
+				f, err := m.readFeed(L, options, m.getPagePath(filename).Link)
+				if err != nil {
+					L.RaiseError("%v", err)
+				}
+
+				output, err := format(f)
+				if err != nil {
+					L.RaiseError("%v", err)
+				}
+
+				L.Push(lua.LString(output))
+				return 1
+			}
 		}
-		t.RawSetString(k, lv)
-	}
-	return t
+
+		L.SetField(mod, "atom", L.NewFunction(generate((*feed).atom)))
+		L.SetField(mod, "rss", L.NewFunction(generate((*feed).rss)))
+
+		L.Push(mod)
+		return 1
+	})
 }
 
-func arrayToLTable[T any](L *lua.LState, items []T) *lua.LTable {
-	t := L.NewTable()
-	for _, v := range items {
-		var lv lua.LValue
-		var x any = v
-		switch v := x.(type) {
-		case float32:
-			lv = lua.LNumber(v)
-		case float64:
-			lv = lua.LNumber(v)
-		case int:
-			lv = lua.LNumber(v)
-		case int8:
-			lv = lua.LNumber(v)
-		case int16:
-			lv = lua.LNumber(v)
-		case int32:
-			lv = lua.LNumber(v)
-		case int64:
-			lv = lua.LNumber(v)
-		case string:
-			lv = lua.LString(v)
-		case bool:
-			lv = lua.LBool(v)
-		default:
-			lv = luar.New(L, v)
-		}
-		t.Append(lv)
+// mustToLua is ToLua for values that are known to be convertible,
+// and raises a lua error otherwise.
+func mustToLua(L *lua.LState, value any) lua.LValue {
+	lv, err := ToLua(L, value)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
 	}
-	return t
+	return lv
 }
 
-func pageDataToLValue(L *lua.LState, data PageData) lua.LValue {
-	t := L.NewTable()
-	for k, v := range data {
-		var lv lua.LValue
-		switch v := v.(type) {
-		case float32:
-			lv = lua.LNumber(v)
-		case float64:
-			lv = lua.LNumber(v)
-		case int:
-			lv = lua.LNumber(v)
-		case int8:
-			lv = lua.LNumber(v)
-		case int16:
-			lv = lua.LNumber(v)
-		case int32:
-			lv = lua.LNumber(v)
-		case int64:
-			lv = lua.LNumber(v)
-
-		case string:
-			lv = lua.LString(v)
-		case bool:
-			lv = lua.LBool(v)
-		default:
-			lv = luar.New(L, v)
-		}
-		t.RawSetString(k, lv)
+// addedValueToLua converts a value added with SetGlobal or SetModule.
+// Values with methods are passed with luar.New so that the methods
+// can be called from lua, other values are converted with ToLua.
+func addedValueToLua(L *lua.LState, value any) (lua.LValue, error) {
+	t := reflect.TypeOf(value)
+	if t != nil && t.NumMethod() > 0 && t != timeType &&
+		!t.Implements(luaValueType) &&
+		!t.Implements(jsonMarshalerType) &&
+		!t.Implements(textMarshalerType) {
+		return luar.New(L, value), nil
 	}
-	return t
+	return ToLua(L, value)
+}
+
+// checkAddedValue returns the error of addedValueToLua, if any.
+// The value is converted in a throwaway state, since the
+// added values are converted again for each new state.
+func checkAddedValue(value any) error {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	_, err := addedValueToLua(L, value)
+	return err
 }
 
 func getLoadedModule(L *lua.LState, moduleName string) lua.LValue {
@@ -1,7 +1,12 @@
 package moontpl
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"os"
@@ -92,3 +97,54 @@ func wholeExt(path string) string {
 	}
 	return ""
 }
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func copyFile(src, dest string) error {
+	inputFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+
+	outputFile, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	if _, err = io.Copy(outputFile, inputFile); err != nil {
+		return err
+	}
+
+	return inputFile.Sync()
+}
+
+// writeFileWith creates the file and passes a buffered writer of the file to fn.
+func writeFileWith(filename string, fn func(w io.Writer) error) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	if err := fn(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// recoveredError converts a value recovered from a panic into an error.
+func recoveredError(r any) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return fmt.Errorf("panic: %v", r)
+}
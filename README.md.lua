@@ -62,13 +62,17 @@ return MARKDOWN {
         " without any arguments should show the help file:";
 
     PRE ^ CODE {_lang = "bash"} ^ [[
-    |  Usage: moontpl [--luadir LUADIR] [--runtag RUNTAG] [--version] <command> [<args>]
+    |  Usage: moontpl [--luadir LUADIR] [--runtag RUNTAG] [--theme THEME] [--prettyurls] [--basepath BASEPATH] [--timeout TIMEOUT] [--version] <command> [<args>]
     |  
     |  Options:
     |    --luadir LUADIR, -l LUADIR
     |                           directories where to find lua files with require(), automatically includes SITEDIR
     |    --runtag RUNTAG, -t RUNTAG
     |                           runtime tags to include in the lua environment
+    |    --theme THEME          theme directory with files that SITEDIR can override, later themes override the earlier ones
+    |    --prettyurls           serve and build pages as directories, such that /about.html.lua is at /about/
+    |    --basepath BASEPATH    URL path where the site is deployed, such as /docs for https://example.org/docs/
+    |    --timeout TIMEOUT      time limit for rendering a single page when serving or building, 0 for no limit [default: 30s]
     |    --version, -v          show version number
     |    --help, -h             display this help and exit
     |  
@@ -76,7 +80,10 @@ return MARKDOWN {
     |    build
     |    run
     |    serve
+    |    check
     |    luadoc
+    |    config
+    |    init
     ]];
 
     H4 "2. Create a simple site from scratch";
@@ -107,6 +114,122 @@ return MARKDOWN {
 
     P "You can find more examples in the examples repository";
 
+    H4 "Starting from a template";
+
+    P {
+        CODE "moontpl init TEMPLATE DIR";
+        " creates a site from one of the built-in templates: ";
+        CODE "minimal"; " (a single page), ";
+        CODE "blog"; " (posts with a layout and an Atom feed) and ";
+        CODE "docs"; " (pages with a sidebar).";
+    };
+
+    PRE ^ CODE {_lang = "bash"} ^ [[
+    moontpl init blog myblog
+    moontpl serve myblog
+    ]];
+
+    P {
+        "Existing files are not overwritten unless "; CODE "--force";
+        " is given. Besides the template files, init writes a ";
+        CODE ".luarc.json"; " and a copy of the moontpl lua modules in ";
+        CODE ".moontpl/lua";
+        ", so that editors with the lua language server know about\
+         the modules and the globals such as "; CODE "DIV"; ".";
+    };
+
+    H4 "Incremental builds";
+
+    P {
+        CODE "moontpl build";
+        " only renders the pages whose source or lua dependencies changed\
+         since the last build, and only copies the changed static files.\
+         The hashes are kept in a "; CODE ".moontpl-cache";
+        " directory next to OUTPUTDIR, which is not published with the site\
+         and can be added to "; CODE ".gitignore"; ". Use ";
+        CODE "--force"; " to rebuild everything.";
+    };
+
+    H4 "Asset fingerprinting";
+
+    P {
+        CODE "moontpl build --fingerprint";
+        " also writes the static files and the non-HTML outputs (such as ";
+        CODE "style.css"; " from "; CODE "style.css.lua";
+        ") with a content hash in the file name, such as ";
+        CODE "style.3f9a2c1b.css"; ". Use "; CODE 'path.asset("/style.css")';
+        " in the pages to link to the fingerprinted file.";
+    };
+
+    P {
+        "The non-HTML outputs are built before the pages, so that their\
+         fingerprints are known when the pages are rendered.\
+         This is a breaking change: a ";
+        CODE ".css.lua"; " or "; CODE ".js.lua"; " file that used ";
+        CODE "CSS"; " or the other globals without "; CODE 'require("web")';
+        " only worked because it ran after the pages in the same lua state,\
+         and now it has to require the modules that it uses.";
+    };
+
+    H4 "Themes";
+
+    P {
+        "A site can be laid over one or more theme directories with ";
+        CODE "--theme";
+        ". The pages, modules and static files of the themes are used\
+         as if they were in SITEDIR, unless SITEDIR has a file with\
+         the same path. Later themes override the earlier ones.";
+    };
+
+    PRE ^ CODE {_lang = "bash"} ^ [[
+    moontpl build --theme ../theme mysite
+    ]];
+
+    P {
+        CODE "page.list()"; " entries have a "; CODE "layer";
+        " field with the directory that the page comes from,\
+         and the second value returned by "; CODE "site.files()";
+        " maps each file to its directory.";
+    };
+
+    H4 "Configuration";
+
+    P {
+        "The options can be put in a "; CODE "moontpl.toml"; " (or a ";
+        CODE "moontpl.lua";
+        " that returns a table with the same keys) in SITEDIR or in\
+         the current directory. Relative paths are resolved from\
+         the directory of the file.";
+    };
+
+    PRE ^ CODE {_lang = "toml"} ^ [[
+    |luadirs = ["../lib"]
+    |runtags = ["prod"]
+    |themes = ["../theme"]
+    |ignore = ["*.bak", "/drafts"]
+    |siteurl = "https://example.org"
+    |
+    |[build]
+    |output = "public"
+    |minify = true
+    |
+    |[serve]
+    |port = 8000
+    |
+    |# available in lua as require("site").data
+    |[site]
+    |title = "My site"
+    |author = "Ann"
+    ]];
+
+    P {
+        "The command-line flags override the file, and list flags such as ";
+        CODE "--luadir"; " are added to the lists in the file. ";
+        CODE "moontpl config mysite";
+        " prints the resulting configuration. From Go, the same options\
+         can be set with "; CODE "LoadConfig"; " and "; CODE "ApplyConfig"; ".";
+    };
+
     L__________________________________________;
 
     H3 "As Static site generator with golang extensions";
@@ -115,6 +238,75 @@ return MARKDOWN {
 
     H3 "As a Templating Engine";
 
-    EM "TODO";
+    P {
+        "A lua page can be rendered from Go with "; CODE "Render";
+        ", passing the input that the page reads from "; CODE "page.input"; ":";
+    };
+
+    PRE ^ CODE {_lang = "lua"} ^ [[
+    |-- templates/greeting.html.lua
+    |require("web")
+    |local page = require("page")
+    |local user = page.input.user
+    |
+    |local roles = {}
+    |for _, role in ipairs(user.roles) do
+    |    table.insert(roles, LI(role))
+    |end
+    |
+    |return DIV {
+    |    H1 { "Hello, ", user.name },
+    |    UL(roles),
+    |}
+    ]];
+
+    PRE ^ CODE {_lang = "go"} ^ [[
+    |type User struct {
+    |    Name  string   `luar:"name"`
+    |    Roles []string `luar:"roles"`
+    |}
+    |
+    |m := moontpl.New()
+    |output, err := m.Render("templates/greeting.html.lua", map[string]any{
+    |    "user": User{Name: "Ann", Roles: []string{"admin", "editor"}},
+    |})
+    ]];
+
+    P {
+        "Structs, maps and slices are converted into lua tables with ";
+        CODE "ToLua";
+        ". Struct fields are named after their "; CODE "luar";
+        " tag, or the field name if there's none. ";
+        CODE "FromLua"; " and "; CODE "FromLuaInto";
+        " convert lua values back into Go. "; CODE "RenderFS";
+        " does the same for a page read from an "; CODE "fs.FS";
+        ", such as an "; CODE "embed.FS"; ".";
+    };
+
+    H3 "Embedding a Site in a Go Program";
+
+    P {
+        "A whole site can be read from an "; CODE "fs.FS";
+        " instead of a directory by setting "; CODE "SiteFS"; ". ";
+        CODE "SiteDir";
+        " is then only the name used for the page filenames in error\
+         messages, and does not need to exist.";
+    };
+
+    PRE ^ CODE {_lang = "go"} ^ [[
+    |//go:embed site
+    |var content embed.FS
+    |
+    |m := moontpl.New()
+    |m.SiteDir = "/site"
+    |m.SiteFS, _ = fs.Sub(content, "site")
+    |m.AddLuaDir(m.SiteDir)
+    |
+    |// render the pages on each request, errors are only logged
+    |http.Handle("/", m.Handler(moontpl.HandlerOptions{}))
+    |
+    |// or build the site into a directory
+    |err := m.BuildAll("output")
+    ]];
 
 }
@@ -1,7 +1,10 @@
 package moontpl
 
 import (
+	"context"
+	"io"
 	"io/fs"
+	"net/http"
 )
 
 var moontpl *Moontpl
@@ -10,6 +13,18 @@ func RenderFile(filename string) (string, error) {
 	return moontpl.RenderFile(filename)
 }
 
+func Render(filename string, input any) (string, error) {
+	return moontpl.Render(filename, input)
+}
+
+func RenderFS(fsys fs.FS, filename string, input any) (string, error) {
+	return moontpl.RenderFS(fsys, filename, input)
+}
+
+func RenderTo(w io.Writer, filename string, opts RenderOptions) error {
+	return moontpl.RenderTo(w, filename, opts)
+}
+
 func RenderString(code string) (string, error) {
 	return moontpl.RenderString(code)
 }
@@ -22,16 +37,24 @@ func CopyNonSourceFiles(srcDir, destDir string) error {
 	return moontpl.CopyNonSourceFiles(srcDir, destDir)
 }
 
-func Serve(addr string) {
-	moontpl.Serve(addr)
+func Serve(addr string) error {
+	return moontpl.Serve(addr)
+}
+
+func Shutdown(ctx context.Context) error {
+	return moontpl.Shutdown(ctx)
+}
+
+func Handler(opts HandlerOptions) http.Handler {
+	return moontpl.Handler(opts)
 }
 
-func SetGlobal(varname string, obj any) {
-	moontpl.SetGlobal(varname, obj)
+func SetGlobal(varname string, obj any) error {
+	return moontpl.SetGlobal(varname, obj)
 }
 
-func SetModule(moduleName string, modMap ModMap) {
-	moontpl.SetModule(moduleName, modMap)
+func SetModule(moduleName string, modMap ModMap) error {
+	return moontpl.SetModule(moduleName, modMap)
 }
 
 func AddLuaPath(pathStr string) {
@@ -0,0 +1,775 @@
+package moontpl
+
+import (
+	"errors"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func buildExampleSite(t *testing.T, jobs int) string {
+	m := New()
+	m.SiteDir = mustAbs("examples/static-site-simple")
+	m.AddLuaDir(m.SiteDir)
+	m.AddRunTags("build")
+	m.SetBuildJobs(jobs)
+
+	outputDir := t.TempDir()
+	if err := m.BuildAll(outputDir); err != nil {
+		t.Fatal(err)
+	}
+	return outputDir
+}
+
+func TestParallelBuild(t *testing.T) {
+	serialDir := buildExampleSite(t, 1)
+	parallelDir := buildExampleSite(t, 4)
+
+	count := 0
+	err := fs.WalkDir(os.DirFS(serialDir), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		count++
+
+		expected, err := os.ReadFile(filepath.Join(serialDir, p))
+		if err != nil {
+			return err
+		}
+		actual, err := os.ReadFile(filepath.Join(parallelDir, p))
+		if err != nil {
+			return err
+		}
+		if string(expected) != string(actual) {
+			t.Errorf("output of %s differs between serial and parallel builds", p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Error("no files were built")
+	}
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIncrementalBuild(t *testing.T) {
+	siteDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	writeTestFiles(t, siteDir, map[string]string{
+		"base.lua":        `require("web") return function(body) return DIV(body) end`,
+		"index.html.lua":  `local layout = require("base") return layout { P "index" }`,
+		"other.html.lua":  `require("web") return P "other"`,
+		"static/data.txt": `static`,
+	})
+
+	build := func() {
+		m := New()
+		m.SiteDir = siteDir
+		m.AddLuaDir(siteDir)
+		if err := m.BuildAll(outputDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// marks the output files, so that they can be
+	// checked if they were overwritten by the next build
+	mark := func(names ...string) {
+		for _, name := range names {
+			writeTestFiles(t, outputDir, map[string]string{name: "marked"})
+		}
+	}
+	isMarked := func(name string) bool {
+		data, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data) == "marked"
+	}
+
+	build()
+	mark("index.html", "other.html", "static/data.txt")
+	build()
+	for _, name := range []string{"index.html", "other.html", "static/data.txt"} {
+		if !isMarked(name) {
+			t.Errorf("%s was rebuilt even though nothing changed", name)
+		}
+	}
+
+	writeTestFiles(t, siteDir, map[string]string{
+		"base.lua": `require("web") return function(body) return SPAN(body) end`,
+	})
+	build()
+	if isMarked("index.html") {
+		t.Error("index.html was not rebuilt after base.lua changed")
+	}
+	if !isMarked("other.html") {
+		t.Error("other.html was rebuilt even though it doesn't depend on base.lua")
+	}
+}
+
+func TestManifestLocation(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `require("web") return P "index"`,
+		"data.txt":       `static`,
+	})
+
+	// the output is next to the pages, so the cache directory is in the site
+	outputDir := filepath.Join(siteDir, "public")
+	writeTestFiles(t, outputDir, map[string]string{manifestFilename: "{}"})
+
+	for i := 0; i < 2; i++ {
+		m := New()
+		m.SiteDir = siteDir
+		m.ignorePatterns = []string{"/public"}
+		if err := m.BuildAll(outputDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !fsExists(filepath.Join(siteDir, manifestCacheDir, "public.manifest.json")) {
+		t.Errorf("the manifest was not written in %s", manifestCacheDir)
+	}
+	for _, name := range []string{manifestFilename, manifestCacheDir} {
+		if fsExists(filepath.Join(outputDir, name)) {
+			t.Errorf("%s was left in the output directory", name)
+		}
+	}
+	if !fsExists(filepath.Join(outputDir, "data.txt")) {
+		t.Errorf("the static files were not copied")
+	}
+}
+
+func TestBuildSettingsChange(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `return require("path").absolute("about.html")`,
+		"title.html.lua": `return require("site").data.title or "untitled"`,
+		"feed.xml.lua": `
+return require("feed").atom {
+	title = "Feed", link = "index.html",
+	entries = { { title = "Post", link = "index.html", date = "2024-01-02" } },
+}`,
+	})
+
+	for _, test := range []struct {
+		name    string
+		set     func(m *Moontpl)
+		file    string
+		content string
+	}{
+		{"basepath", func(m *Moontpl) { m.BasePath = "/docs" }, "index.html", "/docs/about.html"},
+		{"siteurl", func(m *Moontpl) { m.SiteURL = "https://two.example.org" }, "feed.xml", "https://two.example.org/index.html"},
+		{"sitedata", func(m *Moontpl) { m.SiteData = map[string]any{"title": "Two"} }, "title.html", "Two"},
+	} {
+		outputDir := t.TempDir()
+		for i := 0; i < 2; i++ {
+			m := New()
+			m.SiteDir = siteDir
+			m.SiteURL = "https://one.example.org"
+			m.SiteData = map[string]any{"title": "One"}
+			if i == 1 {
+				test.set(m)
+			}
+			if err := m.BuildAll(outputDir); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		data, err := os.ReadFile(filepath.Join(outputDir, test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), test.content) {
+			t.Errorf("%s: %s was not rebuilt after the setting changed:\n%s", test.name, test.file, data)
+		}
+	}
+
+	// the settings that change which files are used
+	for name, set := range map[string]func(m *Moontpl){
+		"theme":      func(m *Moontpl) { m.AddTheme(t.TempDir()) },
+		"ignore":     func(m *Moontpl) { m.ignorePatterns = append(m.ignorePatterns, "*.md") },
+		"copysource": func(m *Moontpl) { m.builder.copyLuaSourceFiles = true },
+	} {
+		m := New()
+		settings := m.buildSettings()
+		set(m)
+		if m.buildSettings() == settings {
+			t.Errorf("%s: the build settings did not change", name)
+		}
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	siteDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	writeTestFiles(t, siteDir, map[string]string{
+		"a.html.lua": "local x = nil\nreturn x.y",
+		"b.html.lua": `require("web") return P "ok"`,
+		"c.html.lua": "return = 1",
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	err := m.BuildAll(outputDir)
+
+	var errs BuildErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected BuildErrors, got %v", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+	if errs[0].Link != "/a.html" || errs[0].Line != 2 {
+		t.Errorf("unexpected error location: %v", errs[0])
+	}
+	if errs[1].Link != "/c.html" || errs[1].Line != 1 {
+		t.Errorf("unexpected error location: %v", errs[1])
+	}
+	if !fsExists(filepath.Join(outputDir, "b.html")) {
+		t.Error("b.html was not built")
+	}
+}
+
+func TestBuildOutputErrors(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		// the errors are raised while the output is written
+		"attr.html.lua": `require("web")
+return DIV { title=setmetatable({}, { __tostring=function() error("boom") end }) }`,
+		"tostring.html.lua": `require("web")
+return setmetatable({}, { __tostring=function() error("raw boom") end })`,
+		"style.css.lua": `return setmetatable({}, { __tostring=function() error("css boom") end })`,
+		"ok.html.lua":   `require("web") return P "ok"`,
+	})
+
+	for _, tags := range [][]string{nil, {minifyRunTag}} {
+		outputDir := t.TempDir()
+		m := New()
+		m.SiteDir = siteDir
+		m.AddRunTags(tags...)
+		err := m.BuildAll(outputDir)
+
+		var errs BuildErrors
+		if !errors.As(err, &errs) {
+			t.Fatalf("%v: expected BuildErrors, got %v", tags, err)
+		}
+		var messages []string
+		for _, e := range errs {
+			messages = append(messages, e.Link+": "+e.Message)
+		}
+		// the non-html outputs are built first
+		expected := []string{"/style.css: css boom", "/attr.html: boom", "/tostring.html: raw boom"}
+		if !reflect.DeepEqual(messages, expected) {
+			t.Errorf("%v: unexpected errors %q", tags, messages)
+		}
+		if !fsExists(filepath.Join(outputDir, "ok.html")) {
+			t.Errorf("%v: ok.html was not built", tags)
+		}
+	}
+}
+
+func TestBuildJobPanic(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		// the render succeeds, but then the page module can't be found
+		// for the sitemap data, which raises a lua error outside of the render
+		"broken.html.lua": `
+return setmetatable({}, { __tostring=function()
+	package.loaded = nil
+	return "broken"
+end })`,
+		"a.html.lua": `require("web") return P "a"`,
+		"b.html.lua": `require("web") return P "b"`,
+	})
+
+	outputDir := t.TempDir()
+	m := New()
+	m.SiteDir = siteDir
+	m.SiteURL = "https://example.org"
+	m.EnableSitemap(false)
+	m.builder.jobs = 1
+	err := m.BuildAll(outputDir)
+
+	var errs BuildErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected BuildErrors, got %v", err)
+	}
+	if len(errs) != 1 || errs[0].Link != "/broken.html" || !strings.Contains(errs[0].Message, "package.loaded must be a table") {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	for _, name := range []string{"a.html", "b.html"} {
+		if !fsExists(filepath.Join(outputDir, name)) {
+			t.Errorf("%s was not built", name)
+		}
+	}
+}
+
+func TestCopyErrors(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c"})
+
+	for _, failFast := range []bool{false, true} {
+		// a directory in place of the output file makes the copy fail
+		outputDir := t.TempDir()
+		writeTestFiles(t, outputDir, map[string]string{"a.txt/x": "", "c.txt/x": ""})
+
+		m := New()
+		m.SiteDir = siteDir
+		m.builder.failFast = failFast
+		err := m.BuildAll(outputDir)
+
+		var errs BuildErrors
+		if !errors.As(err, &errs) {
+			t.Fatalf("expected BuildErrors, got %v", err)
+		}
+		expected := 2
+		if failFast {
+			expected = 1
+		}
+		if len(errs) != expected {
+			t.Fatalf("failFast=%v: expected %d errors, got %v", failFast, expected, errs)
+		}
+		if errs[0].Source != filepath.Join(siteDir, "a.txt") {
+			t.Errorf("unexpected error source: %v", errs[0])
+		}
+		if fsExists(filepath.Join(outputDir, "b.txt")) == failFast {
+			t.Errorf("failFast=%v: unexpected b.txt in the output", failFast)
+		}
+	}
+}
+
+func TestCleanOutputDir(t *testing.T) {
+	siteDir := t.TempDir()
+	outputDir := filepath.Join(t.TempDir(), "output")
+
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `require("web") return P "index"`,
+		"image.png":      `image`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	if err := m.BuildAll(outputDir); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFiles(t, outputDir, map[string]string{"deleted/page.html": "stale"})
+
+	stale, err := m.CleanOutputDir(outputDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleFile := filepath.Join(outputDir, "deleted/page.html")
+	if len(stale) != 1 || stale[0] != staleFile {
+		t.Fatalf("unexpected stale files: %v", stale)
+	}
+	if !fsExists(staleFile) {
+		t.Fatal("dry run removed a file")
+	}
+
+	if _, err := m.CleanOutputDir(outputDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if fsExists(filepath.Dir(staleFile)) {
+		t.Error("stale file was not removed")
+	}
+	for _, name := range []string{"index.html", "image.png"} {
+		if !fsExists(filepath.Join(outputDir, name)) {
+			t.Errorf("%s was removed", name)
+		}
+	}
+
+	// directories not created by moontpl are left alone
+	otherDir := t.TempDir()
+	writeTestFiles(t, otherDir, map[string]string{"file.txt": "not mine"})
+	if err := m.BuildAll(otherDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CleanOutputDir(otherDir, false); err == nil {
+		t.Error("expected an error when cleaning a directory not created by moontpl")
+	}
+
+	// the previous output of a failed page is not stale
+	writeTestFiles(t, siteDir, map[string]string{"index.html.lua": `error("failed")`})
+	if err := m.BuildAll(outputDir); err == nil {
+		t.Fatal("expected a build error")
+	}
+	if _, err := m.CleanOutputDir(outputDir, false); err == nil {
+		t.Error("expected an error when cleaning after a failed build")
+	}
+	if !fsExists(filepath.Join(outputDir, "index.html")) {
+		t.Error("index.html was removed after a failed build")
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `
+require("web")
+return DIV {
+	H1 {id="top", "title"};
+	A {href="#top", "ok"};
+	A {href="#missing", "broken fragment"};
+	A {href="missing.html", "broken"};
+	A {href="dir/other.html#section", "ok"};
+	A {href="dir/", "ok"};
+	IMG {src="image.png", srcset="image.png 1x, missing.png 2x"};
+	A {href="https://example.com/missing.html", "external"};
+	A {href="mailto:someone@example.com", "mail"};
+}`,
+		"dir/other.html.lua": `require("web") return P {id="section", A {href="../image.png#x"}}`,
+		"dir/index.html.lua": `require("web") return LINK {rel="stylesheet", href="/style.css"}`,
+		"style.css.lua":      `return "body {}"`,
+		"image.png":          ``,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	m.builder.testBuild = true
+	m.builder.checkLinks = true
+	err := m.BuildAll("")
+
+	var errs BuildErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected BuildErrors, got %v", err)
+	}
+
+	source := filepath.Join(siteDir, "index.html.lua")
+	expected := []string{
+		`/index.html: ` + source + `: broken link "#missing": no element with id "missing" in /index.html (line 4 of the rendered page)`,
+		`/index.html: ` + source + `: broken link "missing.html": target not found (line 4 of the rendered page)`,
+		`/index.html: ` + source + `: broken link "missing.png": target not found (line 4 of the rendered page)`,
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), errs)
+	}
+	for i, e := range errs {
+		if e.Error() != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], e.Error())
+		}
+	}
+}
+
+func TestSitemap(t *testing.T) {
+	siteDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `
+require("web")
+local page = require("page")
+page.data.lastmod = "2024-01-02"
+page.data.priority = 0.8
+require("build").queue("/item[id=1].html")
+return P "index"`,
+		"item.html.lua": `
+require("web")
+require("page").data.changefreq = "daily"
+return P "item"`,
+		"hidden.html.lua": `
+require("web")
+require("page").data.sitemap = false
+return P "hidden"`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	m.SiteURL = "https://example.org/docs/"
+	m.EnableSitemap(true)
+	if err := m.BuildAll(outputDir); err != nil {
+		t.Fatal(err)
+	}
+
+	sitemap, err := os.ReadFile(filepath.Join(outputDir, "sitemap.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"<loc>https://example.org/docs/index.html</loc>\n    <lastmod>2024-01-02</lastmod>\n    <priority>0.8</priority>",
+		"<loc>https://example.org/docs/item.html</loc>",
+		"<loc>https://example.org/docs/item%5Bid=1%5D.html</loc>",
+		"<changefreq>daily</changefreq>",
+	} {
+		if !strings.Contains(string(sitemap), expected) {
+			t.Errorf("sitemap doesn't contain %q:\n%s", expected, sitemap)
+		}
+	}
+	if strings.Contains(string(sitemap), "hidden.html") {
+		t.Errorf("sitemap contains excluded page:\n%s", sitemap)
+	}
+
+	robots, err := os.ReadFile(filepath.Join(outputDir, "robots.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(robots), "Sitemap: https://example.org/docs/sitemap.xml") {
+		t.Errorf("unexpected robots.txt:\n%s", robots)
+	}
+}
+
+func TestSitemapBasePath(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `require("web") return P "index"`,
+		"about.html.lua": `require("web") return P "about"`,
+	})
+
+	for _, siteURL := range []string{"https://example.org", "https://example.org/docs"} {
+		outputDir := t.TempDir()
+		m := New()
+		m.SiteDir = siteDir
+		m.SiteURL = siteURL
+		m.BasePath = "/docs"
+		m.EnableSitemap(true)
+		if err := m.BuildAll(outputDir); err != nil {
+			t.Fatal(err)
+		}
+
+		sitemap, err := os.ReadFile(filepath.Join(outputDir, "sitemap.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		robots, err := os.ReadFile(filepath.Join(outputDir, "robots.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range []string{
+			"<loc>https://example.org/docs/index.html</loc>",
+			"<loc>https://example.org/docs/about.html</loc>",
+		} {
+			if !strings.Contains(string(sitemap), expected) {
+				t.Errorf("%s: sitemap doesn't contain %q:\n%s", siteURL, expected, sitemap)
+			}
+		}
+		if !strings.Contains(string(robots), "Sitemap: https://example.org/docs/sitemap.xml\n") {
+			t.Errorf("%s: unexpected robots.txt:\n%s", siteURL, robots)
+		}
+	}
+}
+
+func TestPrettyURLs(t *testing.T) {
+	siteDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `
+require("web")
+return DIV {
+	A { href = "about.html" },
+	A { href = "/post[id=1].html#top" },
+}`,
+		"about.html.lua": `
+require("web")
+return DIV {
+	A { href = "index.html" },
+	A { href = "/post.html" },
+	IMG { src = "img/cat.jpg" },
+	SPAN(require("path").absolute("post.html")),
+	A { href = require("path").relative("/about.html") },
+}`,
+		"post.html.lua": `
+require("web")
+return P { id = "top", require("page").PAGE_LINK }`,
+		"img/cat.jpg": "",
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	m.PrettyURLs = true
+	m.AddRunTags("build")
+	m.builder.checkLinks = true
+	if err := m.BuildAll(outputDir); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"index.html":            {`href="about/"`, `href="/post[id=1]/#top"`},
+		"about/index.html":      {`href="../"`, `href="/post/"`, `src="../img/cat.jpg"`, "<span>/post/</span>", `href="./"`},
+		"post/index.html":       {"/post.html"},
+		"post[id=1]/index.html": {"/post[id=1].html"},
+	}
+	for filename, contents := range expected {
+		data, err := os.ReadFile(filepath.Join(outputDir, filename))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		for _, s := range contents {
+			if !strings.Contains(string(data), s) {
+				t.Errorf("%s doesn't contain %q:\n%s", filename, s, data)
+			}
+		}
+	}
+
+	handler := m.Handler(HandlerOptions{LiveReload: true})
+	for _, test := range []struct{ url, location, body string }{
+		{"/about", "/about/", ""},
+		{"/about.html", "/about/", ""},
+		{"/about/", "", `href="../"`},
+		{"/post%5Bid=2%5D/", "", "/post[id=2].html"},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("%s: expected redirect to %q, got %q", test.url, test.location, location)
+		}
+		if !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("%s: body doesn't contain %q:\n%s", test.url, test.body, w.Body.String())
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	siteDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `
+require("web")
+local path = require("path")
+return DIV {
+	LINK { href = "/style.css" },
+	A { href = "/item[id=1].html" },
+	A { href = "about.html" },
+	A { href = path.absolute("about.html") },
+}`,
+		"about.html.lua": `
+require("web")
+return P "about"`,
+		"item.html.lua": `
+require("web")
+return P "item"`,
+		"style.css": "",
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	m.BasePath = "/docs/"
+	m.AddRunTags("build")
+	m.builder.checkLinks = true
+	if err := m.BuildAll(outputDir); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`href="/docs/style.css"`,
+		`href="/docs/item[id=1].html"`,
+		`href="about.html"`,
+		`href="/docs/about.html"`,
+	} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("index.html doesn't contain %q:\n%s", s, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "item[id=1].html")); err != nil {
+		t.Error(err)
+	}
+
+	handler := m.Handler(HandlerOptions{LiveReload: true})
+	for _, test := range []struct {
+		url    string
+		status int
+	}{
+		{"/", 302},
+		{"/docs/about.html", 200},
+		{"/docs/style.css", 200},
+		{"/about.html", 404},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.url, test.status, w.Code)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	styleSource := func(color string) string {
+		return `return "body { background: url(" .. require("path").asset("/img/cat.jpg") .. "); color: ` + color + ` }"`
+	}
+	styleOutput := func(imgLink, color string) string {
+		return "body { background: url(" + imgLink + "); color: " + color + " }"
+	}
+
+	siteDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `
+require("web")
+local path = require("path")
+return DIV {
+	LINK { href = path.asset("/style.css") },
+	IMG { src = path.asset("img/cat.jpg") },
+	A { href = path.asset("/other.html") },
+}`,
+		"other.html.lua": `require("web") return P "other"`,
+		"style.css.lua":  styleSource("red"),
+		"img/cat.jpg":    "meow",
+	})
+
+	build := func() string {
+		m := New()
+		m.SiteDir = siteDir
+		m.EnableFingerprints()
+		m.builder.checkLinks = true
+		if err := m.BuildAll(outputDir); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(outputDir, "index.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	imgLink := fingerprintedLink("/img/cat.jpg", hashBytes([]byte("meow")))
+	styleLink := fingerprintedLink("/style.css", hashBytes([]byte(styleOutput(imgLink, "red"))))
+
+	index := build()
+	for _, s := range []string{`href="` + styleLink + `"`, `src="` + imgLink + `"`, `href="/other.html"`} {
+		if !strings.Contains(index, s) {
+			t.Errorf("index.html doesn't contain %q:\n%s", s, index)
+		}
+	}
+	for _, name := range []string{"style.css", styleLink, "img/cat.jpg", imgLink} {
+		if _, err := os.Stat(filepath.Join(outputDir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the page must be rebuilt when an asset changes, even though
+	// style.css.lua reads the assets before its own fingerprint is known
+	writeTestFiles(t, siteDir, map[string]string{
+		"style.css.lua": styleSource("blue"),
+	})
+	index = build()
+	styleLink = fingerprintedLink("/style.css", hashBytes([]byte(styleOutput(imgLink, "blue"))))
+	if !strings.Contains(index, `href="`+styleLink+`"`) {
+		t.Errorf("index.html doesn't contain %q:\n%s", styleLink, index)
+	}
+}
@@ -0,0 +1,159 @@
+package moontpl
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"toml/moontpl.toml": `
+luadirs = ["lib"]
+runtags = ["prod"]
+timeout = "5s"
+
+[build]
+output = "public"
+copyfiles = false
+
+[site]
+title = "Site"
+tags = ["a", "b"]
+`,
+		"lua/moontpl.lua": `
+return {
+	luadirs = { "lib" },
+	runtags = { "prod" },
+	timeout = "5s",
+	build = { output = "public", copyfiles = false },
+	site = { title = "Site", tags = { "a", "b" } },
+}`,
+		"bad/moontpl.toml": `prettyurl = true`,
+	})
+
+	copyFiles := false
+	for _, name := range []string{"toml", "lua"} {
+		filename, ok := FindConfigFile(filepath.Join(dir, "none"), filepath.Join(dir, name))
+		if !ok {
+			t.Fatalf("%s: config file not found", name)
+		}
+		cfg, err := LoadConfig(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := Config{
+			LuaDirs: []string{filepath.Join(dir, name, "lib")},
+			RunTags: []string{"prod"},
+			Timeout: "5s",
+			Build:   BuildConfig{OutputDir: filepath.Join(dir, name, "public"), CopyFiles: &copyFiles},
+			Serve:   ServeConfig{Port: 9876},
+		}
+		cfg = cfg.WithDefaults()
+		site := cfg.Site
+		cfg.Site = nil
+		if !reflect.DeepEqual(cfg, expected) {
+			t.Errorf("%s: unexpected config:\n%#v\n%#v", name, cfg, expected)
+		}
+		if site["title"] != "Site" || len(site["tags"].([]any)) != 2 {
+			t.Errorf("%s: unexpected site data: %#v", name, site)
+		}
+	}
+
+	if _, err := LoadConfig(filepath.Join(dir, "bad/moontpl.toml")); err == nil || !strings.Contains(err.Error(), "unknown key prettyurl") {
+		t.Errorf("expected an unknown key error, got %v", err)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `
+local site = require("site")
+return site.data.title .. ":" .. table.concat(site.files(), ",")`,
+		"style.css":              `body {}`,
+		"notes.bak":              `notes`,
+		"drafts/post.html.lua":   `return "draft"`,
+		"blog/drafts/x.html.lua": `return "not a top-level draft"`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	err := m.ApplyConfig(Config{Ignore: []string{"drafts/["}})
+	if err == nil {
+		t.Fatal("expected an error for the invalid pattern")
+	}
+
+	copyFiles := false
+	err = m.ApplyConfig(Config{
+		Ignore:  []string{"*.bak", "/drafts"},
+		Timeout: "2s",
+		Build:   BuildConfig{CopyFiles: &copyFiles},
+		Site:    map[string]any{"title": "Title"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.RenderTimeout != 2*time.Second {
+		t.Errorf("unexpected timeout %v", m.RenderTimeout)
+	}
+
+	outputDir := t.TempDir()
+	if err := m.BuildAll(outputDir); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Title:/blog/drafts/x.html,/index.html,/style.css"; strings.TrimSpace(string(data)) != expected {
+		t.Errorf("unexpected output %q", data)
+	}
+	for _, name := range []string{"style.css", "notes.bak", "drafts/post.html"} {
+		if fsExists(filepath.Join(outputDir, name)) {
+			t.Errorf("%s should not be in the output", name)
+		}
+	}
+	if !fsExists(filepath.Join(outputDir, "blog/drafts/x.html")) {
+		t.Errorf("blog/drafts/x.html is missing in the output")
+	}
+}
+
+func TestSiteDataInPageList(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"layout.lua": `
+local site = require("site")
+return function(title) return title .. " - " .. site.data.title end`,
+		"about.html.lua": `
+local page = require("page")
+page.data.title = require("layout")("About")
+return page.data.title`,
+		"index.html.lua": `
+require("page").data.title = "Home"
+local titles = {}
+for _, entry in ipairs(require("page").list()) do
+	table.insert(titles, entry.data.title)
+end
+return table.concat(titles, ",")`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	m.AddLuaDir(siteDir)
+	if err := m.ApplyConfig(Config{Site: map[string]any{"title": "Site"}}); err != nil {
+		t.Fatal(err)
+	}
+	output, err := m.RenderFile(filepath.Join(siteDir, "index.html.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(output) != "About - Site,Home" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
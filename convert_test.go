@@ -0,0 +1,203 @@
+package moontpl
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type jsonPoint struct{ X, Y int }
+
+func (p jsonPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]int{p.X, p.Y})
+}
+
+func (p *jsonPoint) UnmarshalJSON(data []byte) error {
+	var xy []int
+	if err := json.Unmarshal(data, &xy); err != nil {
+		return err
+	}
+	if len(xy) != 2 {
+		return errors.New("expected [x, y]")
+	}
+	p.X, p.Y = xy[0], xy[1]
+	return nil
+}
+
+func TestConversion(t *testing.T) {
+	type Meta struct {
+		Views int
+	}
+	type Post struct {
+		*Meta
+		Title  string            `luar:"title"`
+		Secret string            `luar:"-"`
+		Date   time.Time         `luar:"date"`
+		Tags   []string          `luar:"tags"`
+		Point  jsonPoint         `luar:"point"`
+		Extra  map[string]any    `luar:"extra"`
+		Counts map[string]uint16 `luar:"counts"`
+	}
+
+	post := Post{
+		Meta:   &Meta{Views: 3},
+		Title:  "Hello",
+		Secret: "x",
+		Date:   time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+		Tags:   []string{"a", "b"},
+		Point:  jsonPoint{1, 2},
+		Extra:  map[string]any{"list": []any{1.0, "two", map[string]any{}}},
+		Counts: map[string]uint16{"x": 1},
+	}
+
+	L := New().createState()
+	defer L.Close()
+
+	lv, err := ToLua(L, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	L.SetGlobal("post", lv)
+	err = L.DoString(`
+		assert(post.Views == 3)
+		assert(post.title == "Hello")
+		assert(post.Secret == nil and post.Title == nil)
+		assert(post.date == "2024-05-06T07:08:09Z")
+		assert(#post.tags == 2 and post.tags[2] == "b")
+		assert(post.point[1] == 1 and post.point[2] == 2)
+		assert(post.extra.list[2] == "two")
+		local n = 0
+		for _ in pairs(post) do n = n + 1 end
+		assert(n == 7, tostring(n))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Post
+	if err := FromLuaInto(lv, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	post.Secret = ""
+	if !reflect.DeepEqual(decoded, post) {
+		t.Errorf("unexpected round trip result:\n%#v\n%#v", decoded, post)
+	}
+
+	value, err := FromLua(L.GetGlobal("post").(*lua.LTable).RawGetString("extra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]any{"list": []any{1.0, "two", map[string]any{}}}; !reflect.DeepEqual(value, expected) {
+		t.Errorf("unexpected FromLua result: %#v", value)
+	}
+
+	cyclicMap := map[string]any{}
+	cyclicMap["self"] = cyclicMap
+	cyclicSlice := []any{nil}
+	cyclicSlice[0] = cyclicSlice
+	for _, v := range []any{cyclicMap, cyclicSlice} {
+		if _, err := ToLua(L, v); err == nil || !strings.Contains(err.Error(), "contains itself") {
+			t.Errorf("expected a cycle error, got %v", err)
+		}
+	}
+
+	if err := L.DoString(`cyclic = { a = {} }; cyclic.a.b = cyclic`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FromLua(L.GetGlobal("cyclic")); err == nil || !strings.Contains(err.Error(), "at .a.b: the value contains itself") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+
+	if err := L.DoString(`bad = { counts = { x = -1 } }`); err != nil {
+		t.Fatal(err)
+	}
+	err = FromLuaInto(L.GetGlobal("bad"), &decoded)
+	var convErr *ConversionError
+	if !errors.As(err, &convErr) || convErr.Path != ".counts.x" {
+		t.Errorf("expected a conversion error at .counts.x, got %v", err)
+	}
+}
+
+func TestModuleData(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `
+local data = require("data")
+local result = {}
+for _, item in ipairs(data.items) do
+	table.insert(result, item.name)
+end
+return table.concat(result, ",")`,
+		"list.html.lua": `
+local page = require("page")
+local result = {}
+for _, entry in ipairs(page.list()) do
+	for k, v in pairs(entry) do
+		if k == "link" then table.insert(result, v) end
+	end
+end
+table.sort(result)
+return table.concat(result, ",")`,
+	})
+
+	type item struct {
+		Name string `luar:"name"`
+	}
+
+	m := New()
+	m.SiteDir = siteDir
+	m.SetModule("data", ModMap{"items": []item{{"a"}, {"b"}}})
+
+	output, err := m.RenderFile(filepath.Join(siteDir, "index.html.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(output) != "a,b" {
+		t.Errorf("unexpected output %q", output)
+	}
+
+	// page.list() runs the pages without the added modules
+	if err := os.Remove(filepath.Join(siteDir, "index.html.lua")); err != nil {
+		t.Fatal(err)
+	}
+	output, err = m.RenderFile(filepath.Join(siteDir, "list.html.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(output) != "/list.html" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestSetGlobalError(t *testing.T) {
+	cyclic := map[string]any{}
+	cyclic["self"] = cyclic
+
+	m := New()
+	if err := m.SetGlobal("cyclic", cyclic); err == nil || !strings.Contains(err.Error(), "global cyclic: ") {
+		t.Errorf("expected a conversion error, got %v", err)
+	}
+	if err := m.SetModule("data", ModMap{"ok": 1, "cyclic": cyclic}); err == nil || !strings.Contains(err.Error(), "data.cyclic: ") {
+		t.Errorf("expected a conversion error, got %v", err)
+	}
+	if err := m.SetGlobal("value", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rejected values are not added, so the states can still be created
+	L := m.createState()
+	defer L.Close()
+	if err := L.DoString(`
+		assert(cyclic == nil and value == 1)
+		assert(not pcall(require, "data"))
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,101 @@
+package moontpl
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDataOutput(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.json.lua": `
+return {
+	title = "Search <index>",
+	count = 2,
+	pages = {
+		{ link = "/a.html", tags = { "x", "y" } },
+		{ link = "/b.html", draft = true, tags = {} },
+	},
+	[10] = "ten",
+}`,
+		"compact.json.lua": `
+require("page").data.pretty = false
+return { b = { 1, 2.5 }, a = {} }`,
+		"config.yaml.lua": `
+return {
+	name = "site",
+	version = "1.0",
+	enabled = "yes",
+	pages = {
+		{ link = "/a.html", tags = { "x" } },
+	},
+	empty = {},
+}`,
+		"cycle.json.lua": `
+local t = {}
+t.self = t
+return t`,
+		"string.json.lua": `return '{"raw": true}'`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+
+	for filename, expected := range map[string]string{
+		"index.json.lua": `{
+  "10": "ten",
+  "count": 2,
+  "pages": [
+    {
+      "link": "/a.html",
+      "tags": [
+        "x",
+        "y"
+      ]
+    },
+    {
+      "draft": true,
+      "link": "/b.html",
+      "tags": {}
+    }
+  ],
+  "title": "Search <index>"
+}`,
+		"compact.json.lua": `{"a":{},"b":[1,2.5]}`,
+		"config.yaml.lua": `empty: {}
+enabled: "yes"
+name: site
+pages:
+  - link: /a.html
+    tags:
+      - x
+version: "1.0"`,
+		"string.json.lua": `{"raw": true}`,
+	} {
+		output, err := m.RenderFile(filepath.Join(siteDir, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(output) != expected {
+			t.Errorf("%s: unexpected output:\n%s", filename, output)
+		}
+	}
+
+	if _, err := m.RenderFile(filepath.Join(siteDir, "cycle.json.lua")); err == nil {
+		t.Error("expected an error for a table that contains itself")
+	}
+
+	handler := m.Handler(HandlerOptions{LiveReload: true})
+	for url, contentType := range map[string]string{
+		"/index.json":  "application/json",
+		"/config.yaml": "application/yaml",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if actual := w.Header().Get("Content-Type"); actual != contentType {
+			t.Errorf("%s: expected Content-Type %q, got %q", url, contentType, actual)
+		}
+	}
+}
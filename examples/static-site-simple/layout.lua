@@ -1,11 +1,12 @@
 require("web")
 local tags = require "runtags"
+local path = require "path"
 
 return function(args)
     return HTML {
         HEAD {
             TITLE="Simple example site";
-            LINK {rel="stylesheet"; href="/style.css"};
+            LINK {rel="stylesheet"; href=path.asset("/style.css")};
             STYLE {
                 CSS "a" {
                     color="red";
@@ -1,3 +1,5 @@
+require("web")
+
 return CSS {
     CSS "body" {
         color="white";
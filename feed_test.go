@@ -0,0 +1,143 @@
+package moontpl
+
+import (
+	"encoding/xml"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFeed(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"blog/first.html.lua": `
+local page = require("page")
+page.data.title = "First & oldest"
+page.data.date = "2024-01-02"
+page.data.desc = "<b>first</b> post"
+page.data.author = "First Author"
+return "first"`,
+		"blog/second.html.lua": `
+local page = require("page")
+page.data.title = "Second"
+page.data.date = "2024-03-04T10:00:00Z"
+page.data.author = "second@example.org (Second Author)"
+return "second"`,
+		"undated/feed.xml.lua": `
+return require("feed").atom { title = "Undated", link = "./", entries = { { title = "Post", link = "post.html" } } }`,
+		"blog/feed.xml.lua": `
+local page = require("page")
+local feed = require("feed")
+local posts = {}
+for _, p in ipairs(page.list()) do
+	if p.data.date then table.insert(posts, p) end
+end
+table.sort(posts, function(a, b) return a.data.date > b.data.date end)
+return feed[page.input.format or "atom"] {
+	title = "Blog",
+	link = "./",
+	entries = posts,
+}`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	m.SiteURL = "https://example.org"
+
+	atom, err := m.RenderFile(filepath.Join(siteDir, "blog/feed.xml.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsedAtom atomFeed
+	if err := xml.Unmarshal([]byte(atom), &parsedAtom); err != nil {
+		t.Fatalf("invalid atom feed: %v\n%s", err, atom)
+	}
+	if parsedAtom.Updated != "2024-03-04T10:00:00Z" || len(parsedAtom.Entries) != 2 {
+		t.Fatalf("unexpected atom feed:\n%s", atom)
+	}
+	if e := parsedAtom.Entries[1]; e.Title != "First & oldest" ||
+		e.Link.Href != "https://example.org/blog/first.html" ||
+		e.Updated != "2024-01-02T00:00:00Z" ||
+		e.Summary.Body != "<b>first</b> post" {
+		t.Errorf("unexpected atom entry: %+v", e)
+	}
+	if !strings.Contains(atom, "First &amp; oldest") {
+		t.Errorf("title was not escaped:\n%s", atom)
+	}
+
+	rss, err := m.RenderFile(filepath.Join(siteDir, "blog/feed[format=rss].xml.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsedRSS rssFeed
+	if err := xml.Unmarshal([]byte(rss), &parsedRSS); err != nil {
+		t.Fatalf("invalid rss feed: %v\n%s", err, rss)
+	}
+	if parsedRSS.Channel.Link != "https://example.org/blog/" || len(parsedRSS.Channel.Items) != 2 {
+		t.Fatalf("unexpected rss feed:\n%s", rss)
+	}
+	if item := parsedRSS.Channel.Items[0]; item.PubDate != "Mon, 04 Mar 2024 10:00:00 +0000" || item.Author != "second@example.org (Second Author)" {
+		t.Errorf("unexpected rss item: %+v", item)
+	}
+	// a plain name is not a valid RSS author
+	if !strings.Contains(rss, `xmlns:dc="http://purl.org/dc/elements/1.1/"`) ||
+		!strings.Contains(rss, "<dc:creator>First Author</dc:creator>") ||
+		strings.Contains(rss, "<author>First Author</author>") {
+		t.Errorf("unexpected rss authors:\n%s", rss)
+	}
+
+	// the build time is not used as the date, the output would differ on every build
+	if _, err := m.RenderFile(filepath.Join(siteDir, "undated/feed.xml.lua")); err == nil || !strings.Contains(err.Error(), "no date") {
+		t.Errorf("expected an error for a feed without dates, got %v", err)
+	}
+}
+
+func TestFeedBasePath(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"blog/feed.xml.lua": `
+return require("feed").atom {
+	title = "Blog", link = "./",
+	entries = {
+		{ title = "Post", link = "post.html", date = "2024-01-02" },
+		{ title = "Root", link = "/docs/about.html", date = "2024-01-03" },
+	},
+}`,
+	})
+
+	// the site URL can also include the base path already
+	for _, siteURL := range []string{"https://example.org", "https://example.org/docs/"} {
+		m := New()
+		m.SiteDir = siteDir
+		m.SiteURL = siteURL
+		m.BasePath = "/docs"
+
+		atom, err := m.RenderFile(filepath.Join(siteDir, "blog/feed.xml.lua"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed atomFeed
+		if err := xml.Unmarshal([]byte(atom), &parsed); err != nil {
+			t.Fatalf("invalid atom feed: %v\n%s", err, atom)
+		}
+
+		var links []string
+		for _, link := range parsed.Links {
+			links = append(links, link.Href)
+		}
+		for _, entry := range parsed.Entries {
+			links = append(links, entry.Link.Href)
+		}
+		expected := []string{
+			"https://example.org/docs/blog/",
+			"https://example.org/docs/blog/feed.xml",
+			"https://example.org/docs/blog/post.html",
+			"https://example.org/docs/about.html",
+		}
+		if strings.Join(links, " ") != strings.Join(expected, " ") {
+			t.Errorf("%s: unexpected links %q", siteURL, links)
+		}
+	}
+}
@@ -3,19 +3,19 @@ module github.com/nvlled/moontpl
 go 1.23.0
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/alexflint/go-arg v1.5.1
 	github.com/fsnotify/fsnotify v1.7.0
 	github.com/laher/mergefs v0.1.1
-	github.com/nvlled/htmlformat v0.2.0
 	github.com/samber/lo v1.47.0
 	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/net v0.30.0
 	layeh.com/gopher-luar v1.0.11
 )
 
 require (
 	github.com/alexflint/go-scalar v1.2.0 // indirect
 	github.com/stretchr/testify v1.9.0 // indirect
-	golang.org/x/net v0.30.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/text v0.19.0 // indirect
 )
@@ -0,0 +1,86 @@
+package moontpl
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCreateSiteFromTemplate(t *testing.T) {
+	for _, name := range templateNames() {
+		siteDir := filepath.Join(t.TempDir(), "site")
+		if err := createSiteFromTemplate(name, siteDir, false); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		cfg, err := LoadConfig(filepath.Join(siteDir, "moontpl.toml"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		m := New()
+		m.SiteDir = siteDir
+		m.AddLuaDir(siteDir)
+		if err := m.ApplyConfig(cfg); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		outputDir := t.TempDir()
+		if err := m.BuildAll(outputDir); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !fsExists(filepath.Join(outputDir, "index.html")) {
+			t.Errorf("%s: index.html is missing in the output", name)
+		}
+		if fsExists(filepath.Join(outputDir, ".moontpl")) || fsExists(filepath.Join(outputDir, ".luarc.json")) {
+			t.Errorf("%s: the editor files should not be in the output", name)
+		}
+	}
+
+	siteDir := t.TempDir()
+	if err := createSiteFromTemplate("blog", siteDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(siteDir, ".luarc.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var luarc struct {
+		Library []string `json:"workspace.library"`
+		Globals []string `json:"diagnostics.globals"`
+	}
+	if err := json.Unmarshal(data, &luarc); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(luarc.Library, []string{luaLibraryDir}) || !slices.Contains(luarc.Globals, "DIV") || slices.Contains(luarc.Globals, "print") {
+		t.Errorf("unexpected .luarc.json: %s", data)
+	}
+	if !fsExists(filepath.Join(siteDir, luaLibraryDir, "page.lua")) {
+		t.Errorf("page.lua is missing in %s", luaLibraryDir)
+	}
+
+	index := filepath.Join(siteDir, "index.html.lua")
+	if err := os.WriteFile(index, []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = createSiteFromTemplate("blog", siteDir, false)
+	if err == nil || !strings.Contains(err.Error(), "index.html.lua") {
+		t.Errorf("expected an error about the existing files, got %v", err)
+	}
+	if data, _ := os.ReadFile(index); string(data) != "edited" {
+		t.Errorf("existing file was overwritten")
+	}
+
+	if err := createSiteFromTemplate("blog", siteDir, true); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(index); string(data) == "edited" {
+		t.Errorf("existing file was not overwritten with --force")
+	}
+
+	if err := createSiteFromTemplate("none", t.TempDir(), false); err == nil {
+		t.Errorf("expected an error for an unknown template")
+	}
+}
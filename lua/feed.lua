@@ -0,0 +1,55 @@
+local feed = {}
+
+---@type FeedOptions { title: string, link: string, desc?: string, id?: string, updated?: string, author?: string, siteURL?: string, entries: FeedEntry[] }
+---@type FeedEntry { title: string, link: string, date?: string|number, desc?: string, content?: string|html.Node, author?: string, id?: string }
+--- The feed options. `entries` can be a list of FeedEntry tables,
+--- or the PageEntry items returned by page.list(), in which case
+--- the title, date, desc and author are taken from the page.data.
+---
+--- Links are converted to absolute URLs using `siteURL`, which
+--- defaults to the --siteurl of the build command.
+--- Dates can be a unix timestamp, or a string such as
+--- "2024-01-02", "2024-01-02 15:04" or an RFC 3339 date.
+--- The feed is updated at the newest entry date, or at `updated`
+--- if it's set. A feed without any date is an error.
+---
+--- In RSS, an author with an email address is the <author>,
+--- other names are written as <dc:creator>.
+
+---@param options FeedOptions
+---@return string
+function feed.atom(options) ---
+    --- Returns an Atom feed XML document.
+    ---
+    --- Example:
+    ---     -- in /blog/feed.xml.lua
+    ---     local page = require("page")
+    ---     local feed = require("feed")
+    ---
+    ---     local posts = {}
+    ---     for _, p in ipairs(page.list()) do
+    ---         if p.link:find("^/blog/") and p.data.date then
+    ---             table.insert(posts, p)
+    ---         end
+    ---     end
+    ---     table.sort(posts, function(a, b) return a.data.date > b.data.date end)
+    ---
+    ---     return feed.atom {
+    ---         title = "My blog",
+    ---         link = "/blog/index.html",
+    ---         entries = posts,
+    ---     }
+    -- stub
+    return ""
+end
+
+---@param options FeedOptions
+---@return string
+function feed.rss(options) ---
+    --- Returns an RSS 2.0 feed XML document.
+    --- Takes the same options as feed.atom.
+    -- stub
+    return ""
+end
+
+return feed
@@ -128,6 +128,8 @@ function html.textContent(node)
     end), "")
 end
 
+-- The lua implementation of html.nodeToString, which is
+-- replaced by a Go implementation when loaded in moontpl.
 local function nodeToString(node, level)
     if not node or type(node) ~= "table" or not node.tag then
         return ""
@@ -159,7 +161,7 @@ local function nodeToString(node, level)
         elseif not sub then
             return ""
         end
-        return nodeToString(sub, level)
+        return html.nodeToString(sub, level)
     end), "")
 
     if node.tag == "" then
@@ -170,6 +172,13 @@ local function nodeToString(node, level)
                .. "</" .. node.tag .. ">" .. suffix
 end
 
+---@param node Node
+---@return string
+html.nodeToString = nodeToString ---
+--- Converts node into an HTML string.
+--- tostring(node) is the same as html.nodeToString(node).
+--- The attributes are written in the order they were added to the node.
+
 local appendChild = function(a, b)
     if type(a) == "function" then
         a = a()
@@ -194,7 +203,9 @@ end
 
 nodeMeta = {
     __textContent=html.textContent;
-    __tostring=nodeToString;
+    __tostring=function(node)
+        return html.nodeToString(node)
+    end;
     __div=appendChild;
     __pow=appendChild;
     __call=function(_, a, b)
@@ -17,6 +17,16 @@ page.data = {} ---
 ---   local page = require("page")
 ---   page.data.title = "Home page"
 ---   page.data.desc = "Welcome"
+---
+--- When the sitemap is enabled, the fields lastmod, changefreq and priority
+--- are used for the page entry in sitemap.xml, and the page
+--- is excluded from the sitemap if page.data.sitemap is false.
+---
+--- A .json.lua or .yaml.lua page can return a table instead of a string,
+--- which is then serialized with sorted keys. A table with the keys
+--- 1..n is an array, other tables (including empty ones) are objects.
+--- The output is indented, unless the minify runtag is set or
+--- page.data.pretty is false.
 
 ---@type string
 page.PAGE_LINK = "" ---
@@ -33,11 +43,13 @@ page.PAGE_FILENAME = "" ---
 --- -- in /home/mysite/subdir/page.html.lua
 --- require("page").PAGE_LINK == "/home/mysite/subdir/page.html.lua" -- true
 
----@type PageEntry {absFile: string, relFile: string link: string: data: table}
+---@type PageEntry {absFile: string, relFile: string, link: string, layer: string, data: table}
 ---@return PageEntry[]
 function page.list() ---
-    --- Returns the list of pages found in the SITEDIR.
+    --- Returns the list of pages found in the SITEDIR and in the themes.
     --- PageEntry.data contains the data set by page.data.
+    --- PageEntry.layer is the directory of the site or theme
+    --- that the page comes from.
     -- stub
     return {}
 end
@@ -73,8 +85,13 @@ function page.onRenderDefault(node)
     -- default implementation
     local tags = require("runtags")
     local build = require("build")
+    local path = require("path")
+    local query = require("query")
     if tags.serve then page.appendReloadScript(node) end
     if tags.build then build.queueLocalLinks(node) end
+    if path.PRETTY_URLS or path.BASE_PATH ~= "" then
+        query.rewriteLocalLinks(node, path.url)
+    end
     ---]]
 end
 
@@ -96,7 +113,7 @@ function page.appendReloadScript(node)
     local body = query.select(node, "body") or node
     local contents = [[
         window.addEventListener("load", function() {
-            new EventSource('/.modified').onmessage = function(event) {
+            new EventSource('.modified').onmessage = function(event) {
                 window.location.reload();
             };
         });
@@ -1,5 +1,15 @@
 local path = {}
 
+---@type boolean
+--- True if the site uses pretty URLs, where
+--- /about.html.lua is served at /about/
+path.PRETTY_URLS = false
+
+---@type string
+--- The URL path where the site is deployed, such as "/docs"
+--- for https://example.org/docs/, or "" if the site is at the root.
+path.BASE_PATH = ""
+
 ---@param link string
 ---@return { [string]: string }
 function path.getParams(link) ---
@@ -49,6 +59,11 @@ function path.relative(link) ---
     --- Example:
     ---     -- current page is /dir/index.html
     ---     path.relative("/file.jpg") == "../file.jpg"
+    ---
+    --- With PRETTY_URLS, the link is relative to where
+    --- the page is served:
+    ---     -- current page is /about.html
+    ---     path.relative("/file.jpg") == "../file.jpg"
     -- stub
     return ""
 end
@@ -60,6 +75,50 @@ function path.absolute(link) ---
     --- Example:
     ---     -- current page is /dir/index.html
     ---     path.absolute("./file.jpg") == "/dir/file.jpg"
+    ---
+    --- With PRETTY_URLS, page links are converted to their URL:
+    ---     path.absolute("/about.html") == "/about/"
+    ---     path.absolute("/dir/index.html") == "/dir/"
+    ---
+    --- The BASE_PATH is prepended to the result:
+    ---     -- BASE_PATH is "/docs"
+    ---     path.absolute("/file.jpg") == "/docs/file.jpg"
+    -- stub
+    return ""
+end
+
+---@param link string
+---@return string
+function path.asset(link) ---
+    --- Returns the absolute link of a static file or a non-HTML
+    --- output (such as /style.css from /style.css.lua).
+    --- When the site is built with --fingerprint, this is the link
+    --- of the file with the content hash in its name, which can
+    --- be cached indefinitely. Otherwise, as with `moontpl serve`,
+    --- this is the same as path.absolute(link).
+    --- Example:
+    ---     LINK { rel = "stylesheet", href = path.asset("/style.css") }
+    ---     -- <link rel="stylesheet" href="/style.3f9a2c1b.css">
+    -- stub
+    return ""
+end
+
+---@param link string
+---@return string
+function path.url(link) ---
+    --- Converts a link written relative to the page source
+    --- into a link that works where the page is served.
+    --- Absolute links stay absolute, relative links stay relative.
+    --- Absolute links are prefixed with the BASE_PATH, unless
+    --- they already have it.
+    --- Example:
+    ---     -- current page is /about.html, with PRETTY_URLS
+    ---     path.url("/contact.html") == "/contact/"
+    ---     path.url("contact.html") == "../contact/"
+    ---     path.url("style.css") == "../style.css"
+    ---
+    ---     -- BASE_PATH is "/docs"
+    ---     path.url("/style.css") == "/docs/style.css"
     -- stub
     return ""
 end
@@ -11,7 +11,7 @@ function query.eachNode(root, fn)
 
         fn(node)
 
-        for _, child in ipairs(node.children) do
+        for _, child in ipairs(node.children or {}) do
             if child.tag ~= nil then table.insert(queue, child) end
         end
         ::continue::
@@ -30,7 +30,7 @@ function query.findNodes(root, predicate)
         if not node then goto continue end
 
         if predicate(node) then table.insert(result, node) end
-        for _, child in ipairs(node.children) do
+        for _, child in ipairs(node.children or {}) do
             if child.tag ~= nil then table.insert(queue, child) end
         end
         ::continue::
@@ -38,6 +38,26 @@ function query.findNodes(root, predicate)
     return result
 end
 
+---@param node html.Node
+---@param fn fun(link: string): string
+function query.rewriteLocalLinks(node, fn)
+    --- Recursively replaces the href and src attributes
+    --- that are local links with fn(link).
+    if not node then return end
+
+    query.eachNode(node, function(sub)
+        if not sub or not sub.attrs then return end
+
+        for _, attr in ipairs { "href", "src" } do
+            local link = sub.attrs[attr]
+            if type(link) == "string" and link ~= ""
+                and not link:find ".-://" and link:sub(1, 1) ~= "#" then
+                sub.attrs[attr] = fn(link)
+            end
+        end
+    end)
+end
+
 ---@param node html.Node
 ---@return string[]
 function query.findLocalLinks(node)
@@ -12,6 +12,9 @@ runtags = {} ---
 --- Example:
 --- $ moontpl build -t foo # runtags include: build, foo 
 --- $ moontpl run -t foo   # runtags include: run, foo 
+---
+--- The `minify` tag (or `moontpl build --minify`) makes the
+--- html, css and js output minified instead of formatted.
 
 
 return runtags
@@ -1,10 +1,24 @@
 local site = {}
 
+---@type {[string]: any}
+site.data = {} ---
+--- The site-wide metadata, from the [site] table of the config file.
+---
+--- Example:
+---   -- in moontpl.toml --
+---   [site]
+---   title = "My site"
+---
+---   -- in a page --
+---   require("site").data.title == "My site" -- true
+
 ---@param options? { dir: string, lua: boolean, filter: function(string):boolean }
----@return string[]
+---@return string[], {[string]: string}
 function site.files(options) ---
-    --- List the files found in SITEDIR.
+    --- List the files found in SITEDIR and in the themes.
     --- The returned filenames are absolute URL paths.
+    --- The second returned table maps each filename to the
+    --- directory of the site or theme that the file comes from.
     --- The options defaults to:
     ---  {
     ---      dir = "/",
@@ -23,7 +37,7 @@ function site.files(options) ---
     ---  site.files{filter = function(p)
     ---      return p:find("index") ~= nil
     ---  end }                     -- returns {"/index.html"}
-    return {}
+    return {}, {}
 end
 
 return site
\ No newline at end of file
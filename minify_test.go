@@ -0,0 +1,92 @@
+package moontpl
+
+import (
+	"testing"
+)
+
+func TestMinifyHTML(t *testing.T) {
+	for _, test := range []struct{ input, expected string }{
+		{
+			"<div>\n    <p>Hello,   <b>world</b> !</p>\n</div>",
+			"<div><p>Hello, <b>world</b> !</p></div>",
+		},
+		{
+			`<a href="/x.html" class="a b" title='say "hi"' data-x="">link</a>`,
+			`<a href=/x.html class="a b" title='say "hi"' data-x>link</a>`,
+		},
+		{
+			`<img src="/cat.jpg"/><br/><svg><path d="M0 0"/></svg><x-y a=b/>`,
+			`<img src=/cat.jpg><br><svg><path d="M0 0"/></svg><x-y a=b />`,
+		},
+		{
+			"<p>a <!-- comment --> b</p>",
+			"<p>a b</p>",
+		},
+		{
+			"<pre>\n  keep   this\n</pre>\n<textarea>  and   this </textarea>",
+			"<pre>\n  keep   this\n</pre><textarea>  and   this </textarea>",
+		},
+		{
+			"<style>\n  a  {  color: red;  }\n</style>\n<script>\n  // comment\n  let x = 1;\n</script>",
+			"<style>a{color:red}</style><script>let x = 1;</script>",
+		},
+		{
+			`<script type="text/template">  <b>  x  </b>  </script>`,
+			`<script type=text/template>  <b>  x  </b>  </script>`,
+		},
+	} {
+		if actual := minifyHTML(test.input); actual != test.expected {
+			t.Errorf("minifyHTML(%q)\n  expected: %q\n  got:      %q", test.input, test.expected, actual)
+		}
+	}
+}
+
+func TestMinifyCSS(t *testing.T) {
+	for _, test := range []struct{ input, expected string }{
+		{
+			"/* comment */\nbody {\n  color: red;\n  margin: 0 auto;\n}\n",
+			"body{color:red;margin:0 auto}",
+		},
+		{
+			"a > b, a :hover { content: \"a  /* b */  c\"; width: calc(1px + 2px) }",
+			"a>b,a :hover{content:\"a  /* b */  c\";width:calc(1px + 2px)}",
+		},
+		{
+			"@media screen and (max-width: 100px) { a { color: red } }",
+			"@media screen and (max-width:100px){a{color:red}}",
+		},
+		{
+			"a { b: c;; } d { e: \"f;}\" ; } @import 'g.css' ;",
+			"a{b:c;}d{e:\"f;}\"}@import 'g.css';",
+		},
+	} {
+		if actual := minifyCSS(test.input); actual != test.expected {
+			t.Errorf("minifyCSS(%q)\n  expected: %q\n  got:      %q", test.input, test.expected, actual)
+		}
+	}
+}
+
+func TestMinifyJS(t *testing.T) {
+	for _, test := range []struct{ input, expected string }{
+		{
+			"function f(a, b) {\n    // add\n    return a + b; /* done */\n}\n",
+			"function f(a,b){return a + b;}",
+		},
+		{
+			"let s = 'a // b', r = /\\/\\/ x/g, t = `x  ${1}  y`\nlet d = 4 / 2 / 1",
+			"let s = 'a // b',r = /\\/\\/ x/g,t = `x  ${1}  y`\nlet d = 4 / 2 / 1",
+		},
+		{
+			"a = b\n(c)\nx\n++y",
+			"a = b\n(c)\nx\n++y",
+		},
+		{
+			"const π = 3.14 // ü\nlet s = 'é' + ñ",
+			"const π = 3.14\nlet s = 'é' + ñ",
+		},
+	} {
+		if actual := minifyJS(test.input); actual != test.expected {
+			t.Errorf("minifyJS(%q)\n  expected: %q\n  got:      %q", test.input, test.expected, actual)
+		}
+	}
+}
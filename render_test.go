@@ -1,9 +1,16 @@
 package moontpl
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestSimple(t *testing.T) {
@@ -197,6 +204,389 @@ func TestBuildHook(t *testing.T) {
 	}
 }
 
+func TestOutputProcessor(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `require("web") return DIV { P "hello" }`,
+		"data.xml.lua":   `return "<data>hello</data>"`,
+		"bad.json.lua":   `return "{"`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+
+	formatHTML := m.OutputProcessor(".html")
+	m.RegisterOutputProcessor(".html", func(ctx context.Context, filename string, output []byte) ([]byte, error) {
+		output, err := formatHTML(ctx, filename, output)
+		return append(output, "<!-- processed -->"...), err
+	})
+	m.RegisterOutputProcessor("xml", func(ctx context.Context, filename string, output []byte) ([]byte, error) {
+		return bytes.ToUpper(output), nil
+	})
+	m.RegisterOutputProcessor(".json.lua", func(ctx context.Context, filename string, output []byte) ([]byte, error) {
+		return nil, fmt.Errorf("invalid json in %s", filepath.Base(filename))
+	})
+
+	for filename, expected := range map[string]string{
+		"index.html.lua": "<div>\n    <p>hello</p>\n</div><!-- processed -->",
+		"data.xml.lua":   "<DATA>HELLO</DATA>",
+	} {
+		output, err := m.RenderFile(filepath.Join(siteDir, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(output) != expected {
+			t.Errorf("%s: unexpected output %q", filename, output)
+		}
+	}
+
+	if _, err := m.RenderFile(filepath.Join(siteDir, "bad.json.lua")); err == nil || err.Error() != "invalid json in bad.json.lua" {
+		t.Errorf("expected processor error, got %v", err)
+	}
+}
+
+func TestRenderTo(t *testing.T) {
+	siteDir := t.TempDir()
+	page := `
+require("html").importGlobals()
+local node = HTML {
+	HEAD { META { charset="utf-8" }, STYLE "a > b {}" },
+	BODY {
+		DIV {
+			id="main", data_value="a \"quoted\" 'value'", hidden=true,
+			style={ margin_top=10, color="red" },
+			"1 < 2 & 3 > 2", BR, NBSP, IMG { src="x.jpg" },
+			FRAGMENT { P "one", P "two" },
+			SCRIPT "if (a < b && c) {}",
+		},
+	},
+}
+`
+	writeTestFiles(t, siteDir, map[string]string{
+		"node.html.lua":   page + "return node",
+		"string.html.lua": page + "return tostring(node)",
+	})
+
+	m := New()
+	render := func(filename string, opts RenderOptions) string {
+		var buf bytes.Buffer
+		if err := m.RenderTo(&buf, filepath.Join(siteDir, filename), opts); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	expected := render("string.html.lua", RenderOptions{Raw: true})
+	if output := render("node.html.lua", RenderOptions{Raw: true}); output != expected {
+		t.Errorf("streamed output differs from tostring")
+		printComparison(expected, output)
+	}
+
+	output, err := m.RenderFile(filepath.Join(siteDir, "node.html.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatted := render("node.html.lua", RenderOptions{}); formatted != output {
+		t.Errorf("RenderTo output differs from RenderFile")
+		printComparison(output, formatted)
+	}
+}
+
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestFormatHTMLStream(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `
+require("html").importGlobals()
+local items = {}
+for i = 1, 2000 do
+	items[i] = LI { "item ", i, SPAN "x", PRE "  a\n   b" }
+end
+return HTML { BODY { UL(items), SCRIPT "\n\t\tif (a < b) {}\n" } }
+`,
+		"stray.html.lua": `return "<div>a</div></div></p>b"`,
+	})
+
+	m := New()
+	var raw bytes.Buffer
+	if err := m.RenderTo(&raw, filepath.Join(siteDir, "index.html.lua"), RenderOptions{Raw: true}); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := m.processHTML(context.Background(), "index.html.lua", raw.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var w writeCounter
+	if err := m.RenderTo(&w, filepath.Join(siteDir, "index.html.lua"), RenderOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != string(expected) {
+		t.Errorf("streamed html differs from the buffered formatting")
+		printComparison(string(expected), w.String())
+	}
+	if w.writes < 2 {
+		t.Errorf("expected the output to be written in parts, got %d writes", w.writes)
+	}
+
+	output, err := m.RenderFile(filepath.Join(siteDir, "stray.html.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "\n<div>a</div></div></p>b" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestNodeToString(t *testing.T) {
+	code := `
+local html = require("html")
+html.importGlobals()
+local ITEM = html.CreateNode("item", { prefix="\n", suffix="<!-- end -->" })
+local CUSTOM = html.CreateNode("custom")
+
+local items = {}
+for i = 1, 5000 do
+	items[i] = LI { class="item-" .. i, i % 2 == 0 and "even & <odd>" or EM "odd" }
+end
+
+local node = HTML {
+	HEAD { META { charset="utf-8" }, STYLE "a > b {}", SCRIPT "a < b" },
+	BODY {
+		DIV {
+			z="1", a="2", m="3", data_x="it's \"quoted\"", hidden=true, disabled=false,
+			style={ padding=4, font_size="12px" },
+			"text", 42, BR, HR {}, NBSP, IMG { src="a.jpg", alt="<a>" },
+		},
+		ITEM "with prefix and suffix",
+		ITEM { FRAGMENT { "a", B "b" } },
+		CUSTOM { ["--tostring"]=function(node) return "[" .. node.tag .. "]" end },
+		UL(items),
+	},
+}
+return tostring(node)
+`
+	m := New()
+
+	// without the modules initialized, the html module uses the lua implementation
+	luaState := m.createState(false)
+	defer luaState.Close()
+	if err := luaState.DoString(code); err != nil {
+		t.Fatal(err)
+	}
+	expected := luaState.Get(-1).String()
+
+	L := m.createState()
+	defer L.Close()
+	for i := 0; i < 3; i++ {
+		if err := L.DoString(code); err != nil {
+			t.Fatal(err)
+		}
+		output := L.Get(-1).String()
+		L.Pop(1)
+
+		if output != expected {
+			t.Errorf("output differs from the lua implementation")
+			printComparison(expected, output)
+			break
+		}
+	}
+
+	if !strings.Contains(expected, `<div z="1" a="2" m="3" data-x="it&#39;s &quot;quoted&quot;" hidden disabled style="padding: 4px; font-size: 12px">`) {
+		t.Errorf("unexpected attribute order: %s", expected[:200])
+	}
+}
+
+func TestRenderTimeout(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"loop.html.lua": `
+require("web")
+while true do pcall(function() end) end`,
+		"index.html.lua": `require("web") return P "ok"`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	loopFile := filepath.Join(siteDir, "loop.html.lua")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := m.RenderFileContext(ctx, loopFile)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), loopFile) {
+		t.Errorf("expected a timeout error that names the page, got %v", err)
+	}
+	if len(m.luaPool.saved) != 0 {
+		t.Errorf("cancelled state was returned to the pool")
+	}
+
+	output, err := m.RenderFile(filepath.Join(siteDir, "index.html.lua"))
+	if err != nil || strings.TrimSpace(output) != "<p>ok</p>" {
+		t.Errorf("unexpected output after timeout: %q, %v", output, err)
+	}
+
+	m.RenderTimeout = 50 * time.Millisecond
+	m.AddRunTags("build")
+	err = m.BuildAll(t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected the build to time out, got %v", err)
+	}
+
+	// without a timeout, the context is not made cancellable
+	m.RenderTimeout = 0
+	ctx, cancel = m.renderTimeoutContext(context.Background())
+	defer cancel()
+	if ctx.Done() != nil {
+		t.Errorf("expected a context that can't be cancelled")
+	}
+}
+
+func TestRenderError(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"lib.lua": `
+local M = {}
+function M.boom(x)
+	return x.y.z
+end
+return M`,
+		"index.html.lua": `
+require("web")
+local lib = require("lib")
+local node = DIV { lib.boom({}) }
+return node`,
+		"syntax.html.lua": "require(\"web\")\nreturn DIV {\nend",
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	m.AddLuaPath(filepath.Join(siteDir, "?.lua"))
+
+	page := filepath.Join(siteDir, "index.html.lua")
+	lib := filepath.Join(siteDir, "lib.lua")
+
+	_, err := m.RenderFile(page)
+	var renderErr *RenderError
+	if !errors.As(err, &renderErr) {
+		t.Fatalf("expected a RenderError, got %T: %v", err, err)
+	}
+	if renderErr.Page != page || renderErr.Module != lib || renderErr.Line != 4 {
+		t.Errorf("unexpected location: %+v", renderErr)
+	}
+	if expected := lib + ":4: attempt to index a non-table object(nil) with key 'z'"; err.Error() != expected {
+		t.Errorf("unexpected error message %q", err.Error())
+	}
+	if n := len(renderErr.Frames); n != 2 || renderErr.Frames[1] != (ErrorFrame{page, 4, "main chunk"}) {
+		t.Errorf("unexpected frames: %+v", renderErr.Frames)
+	}
+
+	rec := httptest.NewRecorder()
+	m.respondInternalError(rec, err, HandlerOptions{ErrorPage: ErrorPageDetailed})
+	if body := rec.Body.String(); !strings.Contains(body, `<div class="line error-line">   4  local node = DIV { lib.boom({}) }</div>`) ||
+		!strings.Contains(body, `<div class="line error-line">   4  	return x.y.z</div>`) {
+		t.Errorf("missing source excerpts in error page:\n%s", body)
+	}
+
+	_, err = m.RenderFile(filepath.Join(siteDir, "syntax.html.lua"))
+	if !errors.As(err, &renderErr) || renderErr.Line != 3 || len(renderErr.Frames) != 1 {
+		t.Errorf("unexpected syntax error: %#v", err)
+	}
+}
+
+func TestRender(t *testing.T) {
+	type Author struct {
+		Name  string `luar:"name"`
+		Email string `luar:"-"`
+	}
+	type Base struct {
+		ID int
+	}
+	type Post struct {
+		Base
+		Title   string
+		Author  *Author  `luar:"author"`
+		Tags    []string `luar:"tags"`
+		Meta    map[string]any
+		Date    time.Time
+		private string
+	}
+
+	code := `
+require("web")
+local page = require("page")
+local post = page.input.post
+
+local tags = {}
+for i, tag in ipairs(post.tags) do
+	tags[i] = LI(tag)
+end
+local keys = {}
+for k in pairs(post) do
+	table.insert(keys, k)
+end
+table.sort(keys)
+
+return DIV {
+	H1(post.Title),
+	P { post.ID, " ", post.author.name, " ", tostring(post.author.Email), " ", post.Date },
+	P { post.Meta.views, " ", post.Meta.nested.ok and "nested" or "" },
+	UL(tags),
+	P(table.concat(keys, ",")),
+}`
+	input := map[string]any{
+		"post": &Post{
+			Base:    Base{ID: 7},
+			Title:   "Hello",
+			Author:  &Author{Name: "Ann", Email: "ann@example.org"},
+			Tags:    []string{"a", "b"},
+			Meta:    map[string]any{"views": 10, "nested": map[string]bool{"ok": true}},
+			Date:    time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			private: "x",
+		},
+	}
+	expected := `<div><h1>Hello</h1><p>7 Ann nil 2024-01-02T00:00:00Z</p><p>10 nested</p><ul><li>a</li><li>b</li></ul><p>Date,ID,Meta,Title,author,tags</p></div>`
+
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{"post.html.lua": code})
+
+	m := New()
+	m.AddRunTags(minifyRunTag)
+	output, err := m.Render(filepath.Join(siteDir, "post.html.lua"), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != expected {
+		t.Errorf("unexpected output")
+		printComparison(expected, output)
+	}
+
+	fsys := fstest.MapFS{"templates/post.html.lua": {Data: []byte(code)}}
+	output, err = m.RenderFS(fsys, "templates/post.html.lua", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != expected {
+		t.Errorf("unexpected output from RenderFS")
+		printComparison(expected, output)
+	}
+
+	type Node struct{ Next *Node }
+	node := &Node{}
+	node.Next = node
+	if _, err := m.Render(filepath.Join(siteDir, "post.html.lua"), node); err == nil || !strings.Contains(err.Error(), "contains itself") {
+		t.Errorf("expected an error for a cyclic input, got %v", err)
+	}
+}
+
 func printComparison(expected, actual string) {
 	s := fmt.Sprintf("\n------[expected]------ \n%s\n------[ actual ]------\n%s", expected, actual)
 	println(s)
@@ -0,0 +1,210 @@
+package moontpl
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `return "index"`,
+		"error.html.lua": `error("boom")`,
+		"style.css":      `body {}`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fallback " + r.URL.Path))
+	})
+
+	tests := []struct {
+		opts   HandlerOptions
+		url    string
+		status int
+		body   string
+	}{
+		{HandlerOptions{}, "/", 200, "index"},
+		{HandlerOptions{}, "/style.css", 200, "body {}"},
+		{HandlerOptions{}, "/error.html", 500, "Internal Server Error\n"},
+		{HandlerOptions{}, "/.modified", 404, ""},
+		{HandlerOptions{ErrorPage: ErrorPageDetailed}, "/error.html", 500, "boom"},
+		{HandlerOptions{Fallback: fallback}, "/style.css", 200, "fallback /style.css"},
+		{HandlerOptions{Fallback: fallback}, "/", 200, "index"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		m.Handler(test.opts).ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		body := w.Body.String()
+		if w.Code != test.status || !strings.Contains(body, test.body) {
+			t.Errorf("%+v %s: unexpected response %d %q", test.opts, test.url, w.Code, body)
+		}
+		if test.opts.ErrorPage == ErrorPagePlain && strings.Contains(body, "boom") {
+			t.Errorf("plain error page shows the error details: %q", body)
+		}
+		if !test.opts.LiveReload && strings.Contains(body, "EventSource") {
+			t.Errorf("error page has the reload script without live reload: %q", body)
+		}
+	}
+}
+
+// unflushedWriter hides the http.Flusher of the recorder.
+type unflushedWriter struct {
+	w *httptest.ResponseRecorder
+}
+
+func (u unflushedWriter) Header() http.Header         { return u.w.Header() }
+func (u unflushedWriter) Write(p []byte) (int, error) { return u.w.Write(p) }
+func (u unflushedWriter) WriteHeader(code int)        { u.w.WriteHeader(code) }
+
+func TestLiveReloadFlush(t *testing.T) {
+	m := New()
+	m.SiteDir = t.TempDir()
+	handler := m.Handler(HandlerOptions{LiveReload: true})
+
+	// the stream can't be sent without flushing, which is an error instead of a panic
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(unflushedWriter{w}, httptest.NewRequest("GET", reloadFilename, nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w = httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(w, httptest.NewRequest("GET", reloadFilename, nil).WithContext(ctx))
+	}()
+	listening := func() bool {
+		m.fsWatcher.mu.Lock()
+		defer m.fsWatcher.mu.Unlock()
+		return len(m.fsWatcher.listeners) > 0
+	}
+	for i := 0; i < 50 && !listening(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.fsWatcher.Emit("index.html.lua")
+	cancel()
+	<-done
+	if w.Body.String() != "event: message\ndata: _\n\n" || !w.Flushed {
+		t.Errorf("unexpected event stream %q", w.Body.String())
+	}
+}
+
+func TestLiveReloadMounted(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"sub/index.html.lua": `
+require("html").importGlobals()
+local page = require("page")
+page.onRender = function(node)
+	page.appendReloadScript(node)
+end
+return HTML { BODY { P "hello" } }`,
+		"sub/error.html.lua": `error("boom")`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	mux := http.NewServeMux()
+	mux.Handle("/docs/", http.StripPrefix("/docs", m.Handler(HandlerOptions{LiveReload: true, ErrorPage: ErrorPageDetailed})))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	scriptURL := regexp.MustCompile(`new EventSource\('([^']*)'\)`)
+	for _, pageURL := range []string{"/docs/sub/", "/docs/sub/error.html"} {
+		resp, err := http.Get(server.URL + pageURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		match := scriptURL.FindSubmatch(body)
+		if match == nil {
+			t.Fatalf("%s: no reload script in %q", pageURL, body)
+		}
+		reloadURL, err := url.Parse(server.URL + pageURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reloadURL = reloadURL.ResolveReference(&url.URL{Path: string(match[1])})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", reloadURL.String(), nil)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Errorf("%s: unexpected response from %s: %d %s", pageURL, reloadURL.Path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		cancel()
+		resp.Body.Close()
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	siteDir := t.TempDir()
+	writeTestFiles(t, siteDir, map[string]string{
+		"index.html.lua": `return "index"`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+
+	listen := func() net.Listener {
+		listener, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return listener
+	}
+
+	// a shutdown while Serve is starting must not be missed
+	m.serverStarting = true
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.serve(listen()); err != nil {
+		t.Errorf("expected nil after shutdown, got %v", err)
+	}
+
+	// but a shutdown with no server running does nothing
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	listener := listen()
+	done := make(chan error)
+	go func() { done <- m.serve(listener) }()
+
+	// the listener is already open, so the request waits for the server
+	resp, err := http.Get("http://" + listener.Addr().String() + reloadFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the open reload stream must not hold up the shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected nil after shutdown, got %v", err)
+	}
+}
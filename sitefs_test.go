@@ -0,0 +1,156 @@
+package moontpl
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSiteFS(t *testing.T) {
+	m := New()
+	m.SiteDir = "/site"
+	m.AddLuaDir(m.SiteDir)
+	m.SiteFS = fstest.MapFS{
+		"lib.lua":          {Data: []byte(`return { name = "lib" }`)},
+		"parts/footer.lua": {Data: []byte(`return "footer"`)},
+		"style.css":        {Data: []byte(`body {}`)},
+		"about.html.lua":   {Data: []byte(`require("page").data.title = "About"; return "about"`)},
+		"index.html.lua": {Data: []byte(`
+local page = require("page")
+local site = require("site")
+page.data.title = "Home"
+
+local titles = {}
+for _, entry in ipairs(page.list()) do
+	table.insert(titles, entry.data.title)
+end
+table.sort(titles)
+
+return table.concat({
+	require("lib").name,
+	dofile("parts/footer"),
+	loadfile("parts/footer")(),
+	table.concat(titles, " "),
+	table.concat(site.files(), " "),
+}, ",")`)},
+	}
+
+	expected := "lib,footer,footer,About Home,/about.html /index.html /style.css"
+
+	output, err := m.RenderFile("/site/index.html.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(output) != expected {
+		t.Errorf("unexpected output %q", output)
+	}
+
+	handler := m.Handler(HandlerOptions{})
+	for url, body := range map[string]string{"/": expected, "/style.css": "body {}", "/about.html": "about"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != 200 || strings.TrimSpace(w.Body.String()) != body {
+			t.Errorf("%s: unexpected response %d %q", url, w.Code, w.Body.String())
+		}
+	}
+
+	outputDir := t.TempDir()
+	if err := m.BuildAll(outputDir); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{"index.html": expected, "about.html": "about", "style.css": "body {}"} {
+		data, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(data)) != contents {
+			t.Errorf("%s: unexpected contents %q", name, data)
+		}
+	}
+
+	m.SiteFS.(fstest.MapFS)["broken.html.lua"] = &fstest.MapFile{Data: []byte("return {")}
+	if _, err := m.RenderFile("/site/broken.html.lua"); err == nil || !strings.Contains(err.Error(), "/site/broken.html.lua") {
+		t.Errorf("expected an error with the site filename, got %v", err)
+	}
+}
+
+func TestThemes(t *testing.T) {
+	baseDir := t.TempDir()
+	themeDir := filepath.Join(baseDir, "theme")
+	childThemeDir := filepath.Join(baseDir, "child-theme")
+	siteDir := filepath.Join(baseDir, "site")
+
+	writeTestFiles(t, themeDir, map[string]string{
+		"layout.lua":         `return function(body) return "[" .. body .. "]" end`,
+		"partials/nav.lua":   `return "theme-nav"`,
+		"css/style.css":      `theme`,
+		"img/logo.png":       `logo`,
+		"about.html.lua":     `return require("layout")("theme-about")`,
+		"index.html.lua":     `return "theme-index"`,
+		"blog/post.html.lua": `return "theme-post"`,
+	})
+	writeTestFiles(t, childThemeDir, map[string]string{
+		"partials/nav.lua": `return "child-nav"`,
+		"css/style.css":    `child`,
+	})
+	writeTestFiles(t, siteDir, map[string]string{
+		"css/style.css": `site`,
+		"index.html.lua": `
+local page = require("page")
+local site = require("site")
+local layers = {}
+for _, entry in ipairs(page.list()) do
+	table.insert(layers, entry.link .. "=" .. entry.layer)
+end
+table.sort(layers)
+local _, fileLayers = site.files()
+return require("layout")(table.concat({
+	dofile("partials/nav"),
+	table.concat(layers, " "),
+	fileLayers["/css/style.css"],
+	fileLayers["/img/logo.png"],
+}, ","))`,
+	})
+
+	m := New()
+	m.SiteDir = siteDir
+	m.AddLuaDir(siteDir)
+	m.AddTheme(themeDir)
+	m.AddTheme(childThemeDir)
+
+	expectedIndex := "[child-nav," +
+		"/about.html=" + themeDir + " /blog/post.html=" + themeDir + " /index.html=" + siteDir + "," +
+		siteDir + "," + themeDir + "]"
+
+	outputDir := t.TempDir()
+	if err := m.BuildAll(outputDir); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		"index.html":     expectedIndex,
+		"about.html":     "[theme-about]",
+		"blog/post.html": "theme-post",
+		"css/style.css":  "site",
+		"img/logo.png":   "logo",
+	} {
+		data, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(data)) != contents {
+			t.Errorf("%s: unexpected contents %q", name, data)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(siteDir, "css/style.css")); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	m.Handler(HandlerOptions{}).ServeHTTP(w, httptest.NewRequest("GET", "/css/style.css", nil))
+	if body := w.Body.String(); body != "child" {
+		t.Errorf("expected the file of the child theme, got %q", body)
+	}
+}
@@ -0,0 +1,63 @@
+package moontpl
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIndependentInstances(t *testing.T) {
+	newSite := func(name string) (*Moontpl, string) {
+		siteDir := t.TempDir()
+		writeTestFiles(t, siteDir, map[string]string{
+			"lib.lua": `return { name = "` + name + `" }`,
+			"index.html.lua": `
+local tags = {}
+for k in pairs(require("runtags")) do table.insert(tags, k) end
+table.sort(tags)
+return require("lib").name .. "," .. require("shared").name .. "," .. table.concat(tags, " ")`,
+		})
+
+		m := New()
+		m.SiteDir = siteDir
+		m.AddLuaDir(siteDir)
+		m.AddRunTags("tag-" + name)
+		m.AddFs(fstest.MapFS{
+			"lua/shared.lua": {Data: []byte(`return { name = "shared-` + name + `" }`)},
+		})
+		return m, filepath.Join(siteDir, "index.html.lua")
+	}
+
+	a, pageA := newSite("a")
+	b, pageB := newSite("b")
+
+	sites := []struct {
+		m        *Moontpl
+		page     string
+		expected string
+	}{
+		{a, pageA, "a,shared-a,tag-a"},
+		{b, pageB, "b,shared-b,tag-b"},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, site := range sites {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				output, err := site.m.RenderFile(site.page)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if strings.TrimSpace(output) != site.expected {
+					t.Errorf("expected %q, got %q", site.expected, output)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
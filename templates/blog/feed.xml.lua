@@ -0,0 +1,10 @@
+local feed = require("feed")
+local site = require("site")
+local posts = require("posts")
+
+return feed.atom {
+    title = site.data.title;
+    link = "/index.html";
+    author = site.data.author;
+    entries = posts();
+}
@@ -0,0 +1,17 @@
+require("web")
+local LAYOUT = require("layout")
+local posts = require("posts")
+
+local items = {}
+for _, post in ipairs(posts()) do
+    table.insert(items, LI {
+        A { href=post.link; post.data.title };
+        " ";
+        SMALL(post.data.date);
+    })
+end
+
+return LAYOUT {
+    H1 "Posts";
+    UL(items);
+}
@@ -0,0 +1,27 @@
+require("web")
+local site = require("site")
+
+-- LAYOUT { title = "Page title"; ... } wraps the page contents.
+return function(args)
+    local title = args.title and (args.title .. " - " .. site.data.title) or site.data.title
+    args.title = nil
+
+    return HTML {
+        HEAD {
+            META { charset="utf-8" };
+            TITLE(title);
+            LINK { rel="stylesheet"; href="/style.css" };
+            LINK { rel="alternate"; type="application/atom+xml"; href="/feed.xml" };
+        };
+        BODY {
+            DIV {
+                class="header";
+                A { href="/index.html"; site.data.title };
+                " · ";
+                A { href="/feed.xml"; "Feed" };
+            };
+            DIV { class="main"; args };
+            DIV { class="footer"; "by ", site.data.author };
+        };
+    }
+end
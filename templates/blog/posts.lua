@@ -0,0 +1,13 @@
+local page = require("page")
+
+-- Returns the posts in /posts/, the newest first.
+return function()
+    local posts = {}
+    for _, p in ipairs(page.list()) do
+        if p.link:find("^/posts/") and p.data.date then
+            table.insert(posts, p)
+        end
+    end
+    table.sort(posts, function(a, b) return a.data.date > b.data.date end)
+    return posts
+end
@@ -0,0 +1,13 @@
+require("web")
+local page = require("page")
+local LAYOUT = require("layout")
+
+page.data.title = "Hello, world"
+page.data.date = "2024-01-01"
+page.data.desc = "The first post."
+
+return LAYOUT {
+    title = page.data.title;
+    H1(page.data.title);
+    P "This is the first post. Copy this file to write a new one.";
+}
@@ -0,0 +1,11 @@
+require("web")
+local page = require("page")
+local LAYOUT = require("layout")
+
+page.data.title = "Getting started"
+page.data.order = 2
+
+return LAYOUT {
+    P "To add a page, create a .html.lua file that sets page.data.title and page.data.order.";
+    PRE { CODE "moontpl serve ." };
+}
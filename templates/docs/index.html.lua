@@ -0,0 +1,13 @@
+require("web")
+local page = require("page")
+local LAYOUT = require("layout")
+
+page.data.title = "Introduction"
+page.data.order = 1
+
+return LAYOUT {
+    P "Welcome to the docs.";
+    P {
+        "Start with the "; A { href="getting-started.html"; "getting started" }; " guide.";
+    };
+}
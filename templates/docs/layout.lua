@@ -0,0 +1,44 @@
+require("web")
+local page = require("page")
+local site = require("site")
+
+-- The sidebar lists the pages that have page.data.order, in that order.
+local function sidebar()
+    local pages = {}
+    for _, p in ipairs(page.list()) do
+        if p.data.order then
+            table.insert(pages, p)
+        end
+    end
+    table.sort(pages, function(a, b) return a.data.order < b.data.order end)
+
+    local items = {}
+    for _, p in ipairs(pages) do
+        local class = p.link == page.PAGE_LINK and "current" or nil
+        table.insert(items, LI { A { href=p.link; class=class; p.data.title } })
+    end
+    return DIV { class="sidebar"; UL(items) }
+end
+
+-- LAYOUT { ... } wraps the page contents, page.data.title is the page title.
+return function(args)
+    return HTML {
+        HEAD {
+            META { charset="utf-8" };
+            TITLE(page.data.title .. " - " .. site.data.title);
+            LINK { rel="stylesheet"; href="/style.css" };
+        };
+        BODY {
+            DIV { class="header"; A { href="/index.html"; site.data.title } };
+            DIV {
+                class="content";
+                sidebar();
+                DIV {
+                    class="main";
+                    H1(page.data.title);
+                    args;
+                };
+            };
+        };
+    }
+end
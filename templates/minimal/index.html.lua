@@ -0,0 +1,14 @@
+require("web")
+local site = require("site")
+
+return HTML {
+    HEAD {
+        META { charset="utf-8" };
+        TITLE(site.data.title);
+        LINK { rel="stylesheet"; href="style.css" };
+    };
+    BODY {
+        H1(site.data.title);
+        P "Edit index.html.lua, and see the changes with moontpl serve.";
+    };
+}
@@ -0,0 +1,10 @@
+require("web")
+local page = require("page")
+
+page.onRender = function(node)
+    table.insert(node.children, SPAN "[hook]")
+end
+
+return DIV {
+    P "hello"
+}